@@ -0,0 +1,88 @@
+/*
+Copyright © 2022 Moises P. Sena <moisespsena@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+const starterConfig = `# md2latex config. The command line flags take precedence over it.
+
+# The markdown file to convert (SRC) and the generated tex file (DST), used
+# when no arguments are given. DST may be "tar:FILE[:MAIN]", "zip:..." or
+# "tgz:..." for archives, or "-" for the standard output.
+src: doc.md
+dst: doc.tex
+
+# Generates complete LaTeX documents, with the preamble of the latex options,
+# instead of their body. Implied by --pdf.
+# standalone: true
+
+# The directory SRC, DST and the includes are relative to.
+work_dir: .
+
+# Converts every file named NAME under WORK_DIR, instead of SRC, each to DST
+# in its own directory.
+# find_by:
+#   name: doc.md
+#   work_dir: docs
+
+latex:
+  # The raw LaTeX blocks of the markdown (<!-- ::ID ... -->) are written to
+  # the DEST files.
+  raw_files:
+    # ID: DEST.tex
+
+  envs:
+    # The environment of the block quotes.
+    quotation: quotation
+`
+
+// initCmd represents the init command
+var initCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Write a starter .md2latex.yaml config file in the current directory",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		const name = ".md2latex.yaml"
+		flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if force, _ := cmd.Flags().GetBool("force"); !force {
+			flag |= os.O_EXCL
+		}
+		f, err := os.OpenFile(name, flag, 0666)
+		if os.IsExist(err) {
+			return fmt.Errorf("%s already exists, use --force to overwrite it", name)
+		} else if err != nil {
+			return err
+		}
+		if _, err = f.WriteString(starterConfig); err != nil {
+			f.Close()
+			return err
+		}
+		if err = f.Close(); err == nil {
+			fmt.Println("Written", name)
+		}
+		return err
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(initCmd)
+	initCmd.Flags().BoolP("force", "f", false, "overwrite the existing config file")
+}
@@ -21,8 +21,11 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	m2l "github.com/moisespsena-go/md2latex/pkg"
 	"github.com/spf13/cobra"
@@ -37,6 +40,8 @@ var cfgFile string
 var rootCmd = &cobra.Command{
 	Use:   "md2latex [SRC DST]",
 	Short: "converts markdown to latex",
+	// without it, cobra takes SRC for an unknown subcommand
+	Args: cobra.MaximumNArgs(2),
 	RunE: func(cmd *cobra.Command, args []string) (err error) {
 		if len(args) == 0 {
 			if s := viper.GetString("src"); s != "" {
@@ -51,6 +56,15 @@ var rootCmd = &cobra.Command{
 			return fmt.Errorf("accepts 2 arg(s), received %d", len(args))
 		}
 
+		// expand the environment variables of SRC, DST and the work dirs
+		expandEnv, _ := cmd.Flags().GetBool("expand-env")
+		if !expandEnv {
+			expandEnv = viper.GetBool("expand_env")
+		}
+		if expandEnv {
+			args = []string{os.ExpandEnv(args[0]), os.ExpandEnv(args[1])}
+		}
+
 		var (
 			flags = cmd.Flags()
 
@@ -63,7 +77,7 @@ var rootCmd = &cobra.Command{
 						ret = append(ret, fmt.Sprintf("%s:%s", k, v))
 					}
 				}
-				return nil
+				return
 			}
 			orString = func(a string) string {
 				if v, _ := flags.GetString(a); len(v) > 0 {
@@ -78,17 +92,79 @@ var rootCmd = &cobra.Command{
 			work      = orString("work-dir")
 
 			opts = m2l.Opts{
-				EnvQuotation: viper.GetString("latex.envs.quotation"),
+				EnvQuotation:           viper.GetString("latex.envs.quotation"),
+				EnvQuotationAttributed: viper.GetString("latex.envs.quotation_attributed"),
+				DivEnvironments:        viper.GetStringMapString("latex.envs.divs"),
+				HeadingMap:             viper.GetStringSlice("latex.heading_map"),
+				DateFormat:             viper.GetString("latex.date_format"),
+				TOCDepth:               viper.GetInt("latex.toc_depth"),
+				SecNumDepth:            viper.GetInt("latex.secnum_depth"),
+				NumberWithinSection:    viper.GetBool("latex.number_within_section"),
+				FloatBarriers:          viper.GetBool("latex.float_barriers"),
+				Columns:                viper.GetInt("latex.columns"),
+				BodyEnvironment:        viper.GetString("latex.body_environment"),
+				BodyEnvironmentArgs:    viper.GetStringSlice("latex.body_environment_args"),
+				ListingName:            viper.GetString("latex.listings.name"),
+				ListingUnnumbered:      viper.GetBool("latex.listings.unnumbered"),
+				Languages:              viper.GetString("latex.languages"),
+				MainLanguage:           viper.GetString("latex.main_language"),
+				LanguageQuotes:         viper.GetBool("latex.language_quotes"),
+				DefinitionListAsTable:  viper.GetBool("latex.definition_list_as_table"),
+				BeginDocumentHook:      viper.GetString("latex.begin_document_hook"),
+				BibResource:            viper.GetString("latex.bib_resource"),
+				BibliographyHeading:    viper.GetString("latex.bibliography_heading"),
+				RelativeLinksAsText:    viper.GetBool("latex.relative_links_as_text"),
+				EmailCommand:           viper.GetString("latex.email_command"),
+				HardbreakCommand:       viper.GetString("latex.hardbreak_command"),
+				HorizontalRuleCommand:  viper.GetString("latex.horizontal_rule_command"),
+				HRuleAsNewPage:         viper.GetBool("latex.hrule_as_newpage"),
+				DollarMath:             viper.GetBool("latex.dollar_math"),
+				EnableColorSpans:       viper.GetBool("latex.color_spans"),
+				Highlight:              viper.GetBool("latex.highlight"),
+				HighlightColor:         viper.GetString("latex.highlight_color"),
+				MainFont:               viper.GetString("latex.main_font"),
+				HyperrefOptions:        viper.GetStringMapString("latex.hyperref"),
+				GeometryOptions:        viper.GetString("latex.geometry"),
+				ParSkip:                viper.GetString("latex.par_skip"),
+				ParIndent:              viper.GetString("latex.par_indent"),
+				TableAutoWidth:         viper.GetBool("latex.table_auto_width"),
+				TableZebra:             viper.GetBool("latex.table_zebra"),
+				TableBorderPreset:      viper.GetString("latex.table_border"),
+				BreakURLs:              !viper.IsSet("latex.break_urls") || viper.GetBool("latex.break_urls"),
 			}
 
 			f       finder
 			finderF func(root string, cb func(FS fs.FS, pth string) error) error
 		)
 
+		if expandEnv {
+			work = os.ExpandEnv(work)
+		}
 		if work == "" {
 			work = "."
 		}
 
+		// a file path, or the literal LaTeX preamble
+		if tmpl := viper.GetString("latex.preamble_template"); isLiteralPreamble(tmpl) {
+			opts.PreambleTemplate = tmpl
+		} else if tmpl != "" {
+			var data []byte
+			if data, err = os.ReadFile(tmpl); err != nil {
+				return fmt.Errorf("preamble template: %s", err)
+			}
+			opts.PreambleTemplate = string(data)
+		}
+
+		copy(opts.TableZebraColors[:], viper.GetStringSlice("latex.table_zebra_colors"))
+
+		if viper.IsSet("latex.passthrough_languages") {
+			opts.PassthroughLanguages = viper.GetStringSlice("latex.passthrough_languages")
+		}
+
+		if opts.Keywords, _ = flags.GetStringArray("keyword"); len(opts.Keywords) == 0 {
+			opts.Keywords = viper.GetStringSlice("latex.keywords")
+		}
+
 		if cfg := orSliceMap("latex-raw-file", "latex.raw_files"); len(cfg) > 0 {
 			for _, v := range cfg {
 				if pos := strings.IndexByte(v, ':'); pos > 0 {
@@ -107,12 +183,57 @@ var rootCmd = &cobra.Command{
 			Now:           time.Now(),
 			LatexRawFiles: config,
 			Output:        args[1],
+			OutputDir:     orString("output-dir"),
+			IncludePrefix: orString("include-prefix"),
 			Opts:          opts,
+			ExpandEnv:     expandEnv,
+		}
+
+		if cfg.NoClobber, _ = flags.GetBool("no-clobber"); !cfg.NoClobber {
+			cfg.NoClobber = viper.GetBool("no_clobber")
+		}
+
+		// reproducible archives
+		cfg.TarFileMode = viper.GetInt64("tar_file_mode")
+		if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+			sec, err := strconv.ParseInt(epoch, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid SOURCE_DATE_EPOCH %q", epoch)
+			}
+			cfg.Now = time.Unix(sec, 0).UTC()
+		}
+
+		cfg.Check, _ = flags.GetBool("check")
+		cfg.DryRun, _ = flags.GetBool("dry-run")
+
+		if quiet, _ := flags.GetBool("quiet"); quiet {
+			cfg.Verbosity = m2l.LogQuiet
+		} else if verbose, _ := flags.GetBool("verbose"); verbose {
+			cfg.Verbosity = m2l.LogVerbose
+		}
+
+		if cfg.IgnoreMissingIncludes, _ = flags.GetBool("ignore-missing-includes"); !cfg.IgnoreMissingIncludes {
+			cfg.IgnoreMissingIncludes = viper.GetBool("ignore_missing_includes")
+		}
+
+		if cfg.Vars = viper.GetStringMapString("vars"); cfg.Vars == nil {
+			cfg.Vars = map[string]string{}
+		}
+		vars, _ := flags.GetStringArray("var")
+		for _, v := range vars {
+			pos := strings.IndexByte(v, '=')
+			if pos <= 0 {
+				return fmt.Errorf("invalid var %q, want NAME=VALUE", v)
+			}
+			cfg.Vars[v[:pos]] = v[pos+1:]
 		}
 
 		if err = viper.UnmarshalKey("find_by", &f); err != nil {
 			return
 		}
+		if expandEnv {
+			f.WorkDir = os.ExpandEnv(f.WorkDir)
+		}
 
 		if f.WorkDir == "" || f.WorkDir == "." {
 			f.WorkDir = work
@@ -150,21 +271,141 @@ var rootCmd = &cobra.Command{
 			}
 		}
 
+		pdf, _ := flags.GetBool("pdf")
+		if !pdf {
+			pdf = viper.GetBool("pdf")
+		}
+		engine := orString("engine")
+		if cfg.Opts.Engine, err = m2l.ParseEngine(engine); err != nil {
+			return
+		}
+		standalone, _ := flags.GetBool("standalone")
+		if !standalone {
+			standalone = viper.GetBool("standalone")
+		}
+		if standalone || pdf || f.MergePDF != "" {
+			// the PDFs are compiled from complete documents
+			cfg.Opts.Flags |= m2l.CompletePage
+		}
+		if cfg.Check || cfg.DryRun {
+			// nothing to compile
+			pdf, f.MergePDF = false, ""
+		}
+		if (pdf || f.MergePDF != "") && (cfg.Output == "-" || m2l.IsArchiveDst(cfg.Output)) {
+			return fmt.Errorf("the PDF outputs require a file DST, got %q", cfg.Output)
+		}
+
+		execPDF := func(c m2l.RunConfig) error {
+			if err := m2l.Exec(c); err != nil || !pdf {
+				return err
+			}
+			return m2l.CompilePDF(texPath(c), engine)
+		}
+
 		if finderF != nil {
-			return finderF(work, func(FS fs.FS, pth string) error {
+			jobs, _ := flags.GetInt("jobs")
+			if jobs < 1 {
+				return fmt.Errorf("invalid --jobs %d, want at least 1", jobs)
+			}
+			var (
+				texs []string
+				wg   sync.WaitGroup
+				mu   sync.Mutex
+				errs []string
+				sem  = make(chan struct{}, jobs)
+			)
+			err = finderF(work, func(FS fs.FS, pth string) error {
 				c := cfg
 				c.Input = path.Base(pth)
 				c.RootDir = m2l.FormatFileName(c.RootDir, pth)
 				c.Dir = path.Dir(pth)
 				c.FS = m2l.DirFS(c.RootDir)
-				return m2l.Exec(c)
+				// Exec collects the raw latex values into them
+				c.LatexRawFiles = make(map[string]*m2l.LatexRaw, len(cfg.LatexRawFiles))
+				for k, v := range cfg.LatexRawFiles {
+					c.LatexRawFiles[k] = &m2l.LatexRaw{Dst: v.Dst}
+				}
+				texs = append(texs, texPath(c))
+				if jobs <= 1 {
+					return execPDF(c)
+				}
+				wg.Add(1)
+				sem <- struct{}{}
+				go func() {
+					defer func() {
+						<-sem
+						wg.Done()
+					}()
+					if err := execPDF(c); err != nil {
+						mu.Lock()
+						errs = append(errs, fmt.Sprintf("%s: %s", path.Join(c.Dir, c.Input), err))
+						mu.Unlock()
+					}
+				}()
+				return nil
 			})
+			wg.Wait()
+			if err == nil && len(errs) > 0 {
+				err = fmt.Errorf("%d conversion(s) failed:\n%s", len(errs), strings.Join(errs, "\n"))
+			}
+			if err != nil || f.MergePDF == "" {
+				return
+			}
+			if !filepath.IsAbs(f.MergePDF) {
+				f.MergePDF = filepath.Join(work, f.MergePDF)
+			}
+			return m2l.MergePDF(f.MergePDF, engine, texs, cfg.NoClobber)
 		}
 
-		return m2l.Exec(cfg)
+		if strings.ContainsAny(cfg.Input, "*?[") {
+			// glob: DST is formatted for each file, relative to its dir
+			var matches []string
+			if matches, err = filepath.Glob(filepath.Join(work, cfg.Input)); err != nil {
+				return
+			} else if len(matches) == 0 {
+				return fmt.Errorf("no files match %q", cfg.Input)
+			}
+			if len(matches) > 1 && cfg.Output != "-" && !strings.Contains(cfg.Output, "%B") {
+				return fmt.Errorf("DST %q must contain %%B%% or %%BE%% to convert %d files", cfg.Output, len(matches))
+			}
+			for _, match := range matches {
+				rel, _ := filepath.Rel(work, match)
+				c := cfg
+				c.Input = path.Base(filepath.ToSlash(rel))
+				c.Dir = path.Dir(filepath.ToSlash(rel))
+				c.Output = m2l.FormatFileName(cfg.Output, c.Input)
+				if err = execPDF(c); err != nil {
+					return
+				}
+			}
+			return
+		}
+
+		return execPDF(cfg)
 	},
 }
 
+// isLiteralPreamble reports whether the preamble template tmpl is the LaTeX
+// preamble rather than its file path: it has several lines, or starts with a
+// command, as `\usepackage{x}`. The backslashes of the Windows paths, like
+// `C:\tex\preamble.tex`, don't count.
+func isLiteralPreamble(tmpl string) bool {
+	if strings.Contains(tmpl, "\n") {
+		return true
+	}
+	tmpl = strings.TrimSpace(tmpl)
+	return len(tmpl) > 1 && tmpl[0] == '\\' && unicode.IsLetter(rune(tmpl[1]))
+}
+
+// texPath returns the path of the tex file generated by c.
+func texPath(c m2l.RunConfig) string {
+	outDir := c.RootDir
+	if c.OutputDir != "" {
+		outDir = c.OutputDir
+	}
+	return filepath.Join(outDir, c.Dir, c.Output)
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
@@ -188,6 +429,21 @@ func init() {
 	flags.StringSliceP("latex-raw-file", "R", []string{}, "latex raw files. Example: -R 'ID:DEST.tex'")
 	flags.StringP("joined", "J", "", "name of joined markdown file. If not set, don't save it. Format: %D% (dir), %B% (base name without ext), %BE% (basename with ext)")
 	flags.StringP("work-dir", "w", "", "work directory")
+	flags.StringP("output-dir", "o", "", "directory of the generated files. Defaults to the work directory")
+	flags.BoolP("quiet", "q", false, "no progress output, but the warnings")
+	flags.BoolP("verbose", "v", false, "log the written files too")
+	flags.IntP("jobs", "j", 1, "number of files of find_by converted concurrently")
+	flags.Bool("dry-run", false, "list the files that would be written and their sizes, without writing them")
+	flags.Bool("check", false, "check the document for missing images, broken links and dropped HTML, without writing files")
+	flags.Bool("standalone", false, "generate a complete LaTeX document, with the preamble of the latex options, instead of its body. Implied by --pdf and merge_pdf")
+	flags.Bool("pdf", false, "compile the generated tex file to PDF")
+	flags.String("engine", "", "LaTeX engine of the preamble and of --pdf: pdflatex, xelatex or lualatex. Defaults to pdflatex")
+	flags.Bool("no-clobber", false, "fail if an output file already exists instead of overwriting it")
+	flags.Bool("ignore-missing-includes", false, "render missing included files as LaTeX comments instead of failing")
+	flags.String("include-prefix", "", "prefix of the include lines, and of the code include lines followed by 'code '. Defaults to ':: '")
+	flags.Bool("expand-env", false, "expand the environment variables, like $PROJECT_ROOT, in SRC, DST, the work dirs and the include paths")
+	flags.StringArrayP("keyword", "k", []string{}, "document keyword. Repeat it for each keyword")
+	flags.StringArray("var", []string{}, "replaces {{NAME}} in the markdown, out of the code, by VALUE. Example: --var version=1.2. Write \\{{NAME}} for a literal {{NAME}}")
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -219,4 +475,7 @@ func initConfig() {
 type finder struct {
 	WorkDir string `mapstructure:"work_dir"`
 	Name    string `mapstructure:"name"`
+
+	// MergePDF, when set, is the PDF file merging the PDFs of the found files.
+	MergePDF string `mapstructure:"merge_pdf"`
 }
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStarterConfig(t *testing.T) {
+	dir := t.TempDir()
+	config := strings.Replace(starterConfig, "# ID: DEST.tex", "defs: defs.tex", 1)
+	if config == starterConfig {
+		t.Fatal("raw_files entry not found in the starter config")
+	}
+	for name, data := range map[string]string{
+		".md2latex.yaml": config,
+		"doc.md":         "Text.\n\n<!-- ::defs\n\\def\\x{1}\n-->\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rootCmd.SetArgs([]string{"--config", filepath.Join(dir, ".md2latex.yaml"), "--work-dir", dir, "--quiet"})
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"doc.tex": "Text.\n\n", "defs.tex": "\\def\\x{1}"} {
+		if got, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(got) != want {
+			t.Errorf("%s: got %q, %v, want %q", name, got, err, want)
+		}
+	}
+}
+
+func TestIsLiteralPreamble(t *testing.T) {
+	for tmpl, want := range map[string]bool{
+		`\usepackage{x}`:              true,
+		"% preamble\n\\usepackage{x}": true,
+		"preamble.tex":                false,
+		`C:\tex\preamble.tex`:         false,
+		`tex\preamble.tex`:            false,
+		`\\server\share\preamble.tex`: false,
+	} {
+		if got := isLiteralPreamble(tmpl); got != want {
+			t.Errorf("%q: got %v, want %v", tmpl, got, want)
+		}
+	}
+}
@@ -8,6 +8,7 @@ require (
 	github.com/shopspring/decimal v1.3.1
 	github.com/spf13/cobra v1.4.0
 	github.com/spf13/viper v1.10.1
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 // local dev: replace github.com/russross/blackfriday/v2 => ../../../github.com/russross/blackfriday
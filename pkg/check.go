@@ -0,0 +1,54 @@
+package pkg
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+
+	bf "github.com/russross/blackfriday/v2"
+)
+
+// checkDocument returns the issues of the document ast: missing local images,
+// empty or broken local links and raw HTML blocks, dropped from the output.
+// The local paths are resolved in fsys.
+func checkDocument(ast *bf.Node, fsys *PathFS) (issues []string) {
+	missing := func(dest []byte) bool {
+		u, err := url.Parse(string(dest))
+		if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+			return false
+		}
+		f, err := fsys.FS.Open(fsys.pathOf(u.Path))
+		if err != nil {
+			return true
+		}
+		f.Close()
+		return false
+	}
+
+	ast.Walk(func(node *bf.Node, entering bool) bf.WalkStatus {
+		if !entering {
+			return bf.GoToNext
+		}
+		switch node.Type {
+		case bf.Image:
+			if dest := node.LinkData.Destination; len(dest) == 0 || missing(dest) {
+				issues = append(issues, "missing image: "+string(dest))
+			}
+		case bf.Link:
+			if node.NoteID != 0 {
+				break
+			}
+			if dest := node.LinkData.Destination; len(dest) == 0 {
+				issues = append(issues, "empty link: "+strings.TrimSpace(nodeText(node)))
+			} else if missing(dest) {
+				issues = append(issues, "broken link: "+string(dest))
+			}
+		case bf.HTMLBlock:
+			if !bytes.HasPrefix(bytes.TrimSpace(node.Literal), []byte("<!--")) {
+				issues = append(issues, "unsupported HTML block: "+strings.SplitN(string(node.Literal), "\n", 2)[0])
+			}
+		}
+		return bf.GoToNext
+	})
+	return
+}
@@ -0,0 +1,82 @@
+package pkg
+
+import (
+	"io"
+	"strings"
+
+	bf "github.com/russross/blackfriday/v2"
+)
+
+// parseDirective parses a single line HTML comment directive, like
+// `<!-- div warning -->`, into its name and argument.
+func parseDirective(literal []byte) (name, arg string, ok bool) {
+	s := strings.TrimSpace(string(literal))
+	if !strings.HasPrefix(s, "<!--") || !strings.HasSuffix(s, "-->") {
+		return
+	}
+	s = strings.TrimSpace(s[4 : len(s)-3])
+	if s == "" || strings.ContainsRune(s, '\n') {
+		return
+	}
+	if pos := strings.IndexAny(s, " \t"); pos > 0 {
+		return s[:pos], strings.TrimSpace(s[pos+1:]), true
+	}
+	return s, "", true
+}
+
+// isDirective reports whether the HTML block is a directive rendered by
+// renderDirective.
+func isDirective(literal []byte) bool {
+	name, _, ok := parseDirective(literal)
+	if !ok {
+		return false
+	}
+	switch name {
+	case "div", "/div", "newpage", "clearpage", "table-border", "toc", "lof", "lot":
+		return true
+	}
+	return false
+}
+
+// renderDirective renders the HTML comment directives known by the renderer
+// and reports whether node was one of them.
+func (r *Renderer) renderDirective(w io.Writer, node *bf.Node) bool {
+	name, arg, ok := parseDirective(node.Literal)
+	if !ok {
+		return false
+	}
+	switch name {
+	case "div":
+		env := r.DivEnvironments[arg]
+		r.divs = append(r.divs, env)
+		if env != "" {
+			r.Env(w, env, true)
+		}
+	case "/div":
+		if n := len(r.divs); n > 0 {
+			env := r.divs[n-1]
+			r.divs = r.divs[:n-1]
+			if env != "" {
+				r.Env(w, env, false)
+			}
+		}
+	case "newpage", "clearpage":
+		WriteString(w, `\`+name+"\n\n")
+	case "table-border":
+		// The border preset of the following tables.
+		if err := r.SetOption("table_border", arg); err != nil {
+			r.warnings = append(r.warnings, err.Error())
+		}
+	case "toc":
+		// Places the table of contents here, instead of after the title.
+		r.renderTOC(w)
+		WriteString(w, "\n")
+	case "lof":
+		WriteString(w, `\listoffigures`+"\n\n")
+	case "lot":
+		WriteString(w, `\listoftables`+"\n\n")
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+
+	bf "github.com/russross/blackfriday/v2"
+)
+
+func TestListDirectives(t *testing.T) {
+	tdt := []testData{
+		{input: "a\n\n<!-- lof -->\n\nb", want: "a\n\n\\listoffigures\n\nb\n"},
+		{input: "a\n\n<!-- lot -->\n\nb", want: "a\n\n\\listoftables\n\nb\n"},
+	}
+
+	runTest(t, tdt)
+
+	got := render("% Title\n\n![x](x.png)\n\n<!-- lof -->\n\n# Body\n", bf.Titleblock, Opts{Flags: TOC})
+	if n := strings.Count(got, `\listoffigures`); n != 1 {
+		t.Fatalf("got %d lists of figures in:\n%s", n, got)
+	}
+	if strings.Contains(got, `\tableofcontents`) {
+		t.Errorf("front matter table of contents not suppressed:\n%s", got)
+	}
+}
+
+func TestPageBreakDirectives(t *testing.T) {
+	tdt := []testData{
+		{input: "a\n\n<!-- newpage -->\n\nb", want: "a\n\n\\newpage\n\nb\n"},
+		{input: "a\n\n<!-- clearpage -->\n\nb", want: "a\n\n\\clearpage\n\nb\n"},
+		{input: "a\n\n<!-- unknown -->\n\nb", want: "a\n\nb\n"},
+	}
+
+	runTest(t, tdt)
+}
+
+func TestTexDirective(t *testing.T) {
+	tdt := []testData{
+		{input: `Angle <!--tex $\alpha$ --> here.`, want: `Angle $\alpha$ here.` + "\n"},
+		{input: `Angle <!-- tex \alpha_1 -->.`, want: `Angle \alpha_1.` + "\n"},
+		{input: `Dropped <!-- comment -->.`, want: `Dropped .` + "\n"},
+	}
+
+	runTest(t, tdt)
+}
+
+func TestTOCDirective(t *testing.T) {
+	got := render("% Title\n\n# Intro\n\nText\n\n<!--toc-->\n\n# Body\n", bf.Titleblock, Opts{Flags: TOC, TOCDepth: 2})
+	if n := strings.Count(got, `\tableofcontents`); n != 1 {
+		t.Fatalf("got %d tables of contents in:\n%s", n, got)
+	}
+	intro, toc, body := strings.Index(got, `{Intro}`), strings.Index(got, "\\setcounter{tocdepth}{2}\n\\tableofcontents\n"), strings.Index(got, `{Body}`)
+	if toc < 0 || !(intro < toc && toc < body) {
+		t.Errorf("table of contents not placed between the sections:\n%s", got)
+	}
+}
@@ -0,0 +1,115 @@
+package pkg
+
+import (
+	"bytes"
+	"io"
+	"unicode/utf8"
+)
+
+// EmojiMode controls how emoji shortcodes (`:smile:`) and emoji characters
+// are rendered.
+type EmojiMode int
+
+const (
+	// EmojiNone leaves shortcodes and emoji characters untouched.
+	EmojiNone EmojiMode = iota
+
+	// EmojiCommand renders emojis as `\emoji{name}` commands of the `emoji`
+	// package, which requires LuaLaTeX. With the other engines, it falls back
+	// to EmojiText.
+	EmojiCommand
+
+	// EmojiText replaces emojis with a plain text alternative, safe for pdflatex.
+	EmojiText
+)
+
+type emoji struct {
+	char rune
+	text string
+}
+
+var emojis = map[string]emoji{
+	"smile":            {'😄', ":)"},
+	"grinning":         {'😀', ":D"},
+	"laughing":         {'😆', "xD"},
+	"wink":             {'😉', ";)"},
+	"slightly_smiling": {'🙂', ":)"},
+	"disappointed":     {'😞', ":("},
+	"cry":              {'😢', ":'("},
+	"heart":            {'❤', "<3"},
+	"thumbsup":         {'👍', "(+1)"},
+	"thumbsdown":       {'👎', "(-1)"},
+	"star":             {'⭐', "(*)"},
+	"warning":          {'⚠', "(!)"},
+	"x":                {'❌', "(x)"},
+	"white_check_mark": {'✅', "(v)"},
+	"rocket":           {'🚀', "(rocket)"},
+	"tada":             {'🎉', "(tada)"},
+	"bulb":             {'💡', "(idea)"},
+	"fire":             {'🔥', "(fire)"},
+}
+
+// emojiNames maps emoji characters to their shortcode names.
+var emojiNames = map[rune]string{}
+
+func init() {
+	for name, e := range emojis {
+		emojiNames[e.char] = name
+	}
+}
+
+// emojiMode returns the EmojiMode of the Engine.
+func (r *Renderer) emojiMode() EmojiMode {
+	if r.EmojiMode == EmojiCommand && r.Engine != EngineLuaLaTeX {
+		return EmojiText
+	}
+	return r.EmojiMode
+}
+
+func (r *Renderer) writeEmoji(w io.Writer, name string) {
+	switch r.emojiMode() {
+	case EmojiCommand:
+		WriteString(w, `\emoji{`+name+`}`)
+	case EmojiText:
+		r.Escape(w, []byte(emojis[name].text))
+	}
+}
+
+// EscapeEmojis escapes t like Escape, rendering known emoji shortcodes and
+// emoji characters according to EmojiMode.
+func (r *Renderer) EscapeEmojis(w io.Writer, t []byte) {
+	org := 0
+	for i := 0; i < len(t); {
+		switch {
+		case t[i] == ':':
+			if end := bytes.IndexByte(t[i+1:], ':'); end > 0 {
+				name := string(t[i+1 : i+1+end])
+				if _, ok := emojis[name]; ok {
+					r.Escape(w, t[org:i])
+					r.writeEmoji(w, name)
+					i += end + 2
+					org = i
+					continue
+				}
+			}
+			i++
+		case t[i] >= utf8.RuneSelf:
+			c, size := utf8.DecodeRune(t[i:])
+			if name, ok := emojiNames[c]; ok {
+				r.Escape(w, t[org:i])
+				r.writeEmoji(w, name)
+				i += size
+				// skip the emoji presentation selector
+				if c, size := utf8.DecodeRune(t[i:]); c == '\uFE0F' {
+					i += size
+				}
+				org = i
+				continue
+			}
+			i += size
+		default:
+			i++
+		}
+	}
+	r.Escape(w, t[org:])
+}
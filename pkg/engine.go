@@ -0,0 +1,50 @@
+package pkg
+
+import "fmt"
+
+// Engine is a LaTeX engine.
+type Engine int
+
+const (
+	// EnginePDFLaTeX is pdflatex, with 8-bit fonts.
+	EnginePDFLaTeX Engine = iota
+
+	// EngineXeLaTeX is xelatex, with unicode system fonts.
+	EngineXeLaTeX
+
+	// EngineLuaLaTeX is lualatex, with unicode system fonts.
+	EngineLuaLaTeX
+)
+
+var engineNames = [...]string{
+	EnginePDFLaTeX: "pdflatex",
+	EngineXeLaTeX:  "xelatex",
+	EngineLuaLaTeX: "lualatex",
+}
+
+// String returns the command of the engine.
+func (e Engine) String() string {
+	if e < 0 || int(e) >= len(engineNames) {
+		return fmt.Sprintf("Engine(%d)", int(e))
+	}
+	return engineNames[e]
+}
+
+// Unicode reports whether the engine reads unicode input with fontspec.
+func (e Engine) Unicode() bool {
+	return e == EngineXeLaTeX || e == EngineLuaLaTeX
+}
+
+// ParseEngine returns the engine of the command name. The empty name is
+// EnginePDFLaTeX.
+func ParseEngine(name string) (Engine, error) {
+	if name == "" {
+		return EnginePDFLaTeX, nil
+	}
+	for e, n := range engineNames {
+		if n == name {
+			return Engine(e), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown LaTeX engine %q", name)
+}
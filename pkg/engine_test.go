@@ -0,0 +1,14 @@
+package pkg
+
+import "testing"
+
+func TestParseEngine(t *testing.T) {
+	for name, want := range map[string]Engine{"": EnginePDFLaTeX, "pdflatex": EnginePDFLaTeX, "xelatex": EngineXeLaTeX, "lualatex": EngineLuaLaTeX} {
+		if got, err := ParseEngine(name); err != nil || got != want {
+			t.Errorf("%q: got %v, %v, want %v", name, got, err, want)
+		}
+	}
+	if _, err := ParseEngine("latex"); err == nil {
+		t.Error("no error for an unknown engine")
+	}
+}
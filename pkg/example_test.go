@@ -1,7 +1,7 @@
 package pkg_test
 
 import (
-	"fmt"
+	"os"
 
 	bflatex "github.com/moisespsena-go/md2latex/pkg"
 	bf "github.com/russross/blackfriday/v2"
@@ -32,11 +32,11 @@ Foobar.
 	md := bf.New(bf.WithRenderer(renderer), bf.WithExtensions(extensions))
 
 	ast := md.Parse([]byte(input))
-	fmt.Printf("%s\n", renderer.Render(ast))
+	renderer.Render(os.Stdout, ast)
 	// Output:
-	// \section{Section}
+	// \chapter{Section}
 	// Some \emph{Markdown} text.
 	//
-	// \subsection{Subsection}
+	// \section{Subsection}
 	// Foobar.
 }
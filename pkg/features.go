@@ -0,0 +1,136 @@
+package pkg
+
+import (
+	"bytes"
+
+	bf "github.com/russross/blackfriday/v2"
+)
+
+// featureSet is the content of a document that needs preamble packages.
+type featureSet struct {
+	// Listings (listings).
+	code bool
+
+	// Highlighted listings lines (lstlinebgrd).
+	highlights bool
+
+	// Images (adjustbox and graphicx).
+	images bool
+
+	// Math (amsmath).
+	math bool
+
+	// Tables.
+	tables bool
+
+	// Middle or bottom aligned table columns (array).
+	array bool
+
+	// Strikethrough (ulem).
+	strikethrough bool
+
+	// Color spans (xcolor).
+	colors bool
+
+	// Mark spans and highlights (soul).
+	marks bool
+
+	// The deepest nesting of the lists, LaTeX allows 4 without enumitem.
+	listDepth int
+
+	// Raw LaTeX, which may need any of the packages: raw blocks, `tex`
+	// directives, mapped fenced divs and HtmlBlockHandler output.
+	raw bool
+
+	// The packages of the passthrough code blocks, in order of first use.
+	passthrough []string
+}
+
+// scanFeatures walks ast once and returns the features it uses.
+func (r *Renderer) scanFeatures(ast *bf.Node) (f featureSet) {
+	f.raw = r.BeginDocumentHook != ""
+	seen := map[string]bool{}
+
+	ast.Walk(func(node *bf.Node, entering bool) bf.WalkStatus {
+		if !entering {
+			return bf.GoToNext
+		}
+		switch node.Type {
+		case bf.Code:
+			if bytes.HasPrefix(node.Literal, []byte("$$ ")) {
+				f.math = true
+			} else {
+				f.code = true
+			}
+		case bf.CodeBlock:
+			lang := languageAttr(node.Info)
+			switch {
+			case string(lang) == "math":
+				f.math = true
+			case r.isPassthrough(lang):
+				if pkg := passthroughPackages[string(lang)]; pkg != "" && !seen[pkg] {
+					seen[pkg] = true
+					f.passthrough = append(f.passthrough, pkg)
+				}
+			default:
+				f.code = true
+				if _, ok := infoAttrs(node.Info)["hl"]; ok {
+					f.highlights = true
+				}
+			}
+		case bf.Paragraph:
+			if _, ok := displayMath(node); ok {
+				f.math = true
+			}
+		case bf.Text:
+			if r.DollarMath && bytes.IndexByte(node.Literal, '$') >= 0 {
+				f.math = true
+			}
+			if r.Highlight && bytes.Contains(node.Literal, []byte("==")) {
+				f.colors, f.marks = true, true
+			}
+		case bf.List:
+			depth := 0
+			for p := node; p != nil; p = p.Parent {
+				if p.Type == bf.List {
+					depth++
+				}
+			}
+			if depth > f.listDepth {
+				f.listDepth = depth
+			}
+		case bf.Image:
+			f.images = true
+		case bf.Table:
+			f.tables = true
+		case bf.TableCell:
+			if cellVAlign(node) != 'p' {
+				f.array = true
+			}
+		case bf.Del:
+			f.strikethrough = true
+		case bf.HTMLSpan:
+			if open, _ := spanCommand(node.Literal); r.EnableColorSpans && open != "" {
+				f.colors = true
+				f.marks = f.marks || open == `\hl{`
+			}
+			if name, _, ok := parseDirective(node.Literal); ok && name == "tex" {
+				f.raw = true
+			} else if r.HtmlBlockHandler != nil && !r.rawBlocksOnly {
+				f.raw = true
+			}
+		case bf.HTMLBlock:
+			if name, arg, ok := parseDirective(node.Literal); ok && name == "div" {
+				// the environment may need its packages
+				f.raw = f.raw || r.DivEnvironments[arg] != ""
+			} else if bytes.HasPrefix(node.Literal, []byte("<!-- ::\n")) {
+				// raw latex block, see the HtmlBlockHandler of Exec
+				f.raw = true
+			} else if r.HtmlBlockHandler != nil && !r.rawBlocksOnly && !isDirective(node.Literal) {
+				f.raw = true
+			}
+		}
+		return bf.GoToNext
+	})
+	return
+}
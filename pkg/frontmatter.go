@@ -0,0 +1,90 @@
+package pkg
+
+import (
+	"bytes"
+
+	"gopkg.in/yaml.v2"
+)
+
+// FrontMatter is the document metadata read from a YAML frontmatter block:
+//
+//	---
+//	title: The Title
+//	author: John Doe
+//	date: 2022-04-06
+//	abstract: What it is about.
+//	keywords: [markdown, latex]
+//	---
+type FrontMatter struct {
+	Title    string   `yaml:"title"`
+	Author   string   `yaml:"author"`
+	Date     string   `yaml:"date"`
+	Abstract string   `yaml:"abstract"`
+	Keywords []string `yaml:"keywords"`
+}
+
+// ParseFrontMatter splits the YAML frontmatter block from the start of input.
+// The block opens with a `---` line and closes with a `---` or `...` line.
+// As in pandoc, the opening line isn't followed by a blank line, and the block
+// is a YAML mapping: otherwise, the `---` is a horizontal rule. Without a
+// frontmatter, fm is nil and body is input.
+func ParseFrontMatter(input []byte) (fm *FrontMatter, body []byte, err error) {
+	line, rest := nextLine(input)
+	if string(line) != "---" {
+		return nil, input, nil
+	}
+	if next, _ := nextLine(rest); len(bytes.TrimSpace(next)) == 0 {
+		return nil, input, nil
+	}
+
+	data := rest
+	for len(rest) > 0 {
+		var end []byte
+		start := len(data) - len(rest)
+		if end, rest = nextLine(rest); string(end) == "---" || string(end) == "..." {
+			var mapping yaml.MapSlice
+			if yaml.Unmarshal(data[:start], &mapping) != nil || len(mapping) == 0 {
+				return nil, input, nil
+			}
+			fm = &FrontMatter{}
+			if err = yaml.Unmarshal(data[:start], fm); err != nil {
+				return nil, input, err
+			}
+			return fm, rest, nil
+		}
+	}
+	return nil, input, nil
+}
+
+// nextLine returns the first line of data, without the line ending, and the
+// data after it.
+func nextLine(data []byte) (line, rest []byte) {
+	if pos := bytes.IndexByte(data, '\n'); pos >= 0 {
+		line, rest = data[:pos], data[pos+1:]
+	} else {
+		line = data
+	}
+	return bytes.TrimSuffix(line, []byte("\r")), rest
+}
+
+// Apply copies the metadata into the empty fields of opts.
+func (fm *FrontMatter) Apply(opts *Opts) {
+	if fm == nil {
+		return
+	}
+	if opts.Title == "" {
+		opts.Title = fm.Title
+	}
+	if opts.Author == "" {
+		opts.Author = fm.Author
+	}
+	if opts.Date == "" {
+		opts.Date = fm.Date
+	}
+	if opts.Abstract == "" {
+		opts.Abstract = fm.Abstract
+	}
+	if len(opts.Keywords) == 0 {
+		opts.Keywords = fm.Keywords
+	}
+}
@@ -0,0 +1,63 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+
+	bf "github.com/russross/blackfriday/v2"
+)
+
+func TestParseFrontMatter(t *testing.T) {
+	for _, v := range []struct {
+		input string
+		fm    *FrontMatter
+		body  string
+	}{
+		{input: "# Title\n", body: "# Title\n"},
+		{input: "---\nnot closed\n", body: "---\nnot closed\n"},
+		// horizontal rules
+		{input: "---\n\nText\n\n---\n", body: "---\n\nText\n\n---\n"},
+		{input: "---\nText: with a colon, and more\nText\n---\n", body: "---\nText: with a colon, and more\nText\n---\n"},
+		{input: "---\nSome text.\n---\n", body: "---\nSome text.\n---\n"},
+		{
+			input: "---\ntitle: The Title\nauthor: John Doe\ndate: 2022-04-06\n---\n# Section\n",
+			fm:    &FrontMatter{Title: "The Title", Author: "John Doe", Date: "2022-04-06"},
+			body:  "# Section\n",
+		},
+		{
+			input: "---\nkeywords: [go, latex]\n---\nText",
+			fm:    &FrontMatter{Keywords: []string{"go", "latex"}},
+			body:  "Text",
+		},
+		{
+			input: "---\r\ntitle: T\r\n...\r\nText",
+			fm:    &FrontMatter{Title: "T"},
+			body:  "Text",
+		},
+	} {
+		fm, body, err := ParseFrontMatter([]byte(v.input))
+		if err != nil {
+			t.Errorf("%q: %v", v.input, err)
+			continue
+		}
+		if string(body) != v.body {
+			t.Errorf("%q: got body %q, want %q", v.input, body, v.body)
+		}
+		if !reflect.DeepEqual(fm, v.fm) {
+			t.Errorf("%q: got %+v, want %+v", v.input, fm, v.fm)
+		}
+	}
+}
+
+func TestFrontMatterTitle(t *testing.T) {
+	tdt := []testData{
+		{
+			input: "% Titleblock\n\nText",
+			want:  "\\section*{Front \\& Matter}\n\nText\n",
+			ext:   bf.Titleblock,
+			opts:  Opts{Title: "Front & Matter", FragmentTitle: FragmentTitleSection},
+		},
+	}
+
+	runTest(t, tdt)
+}
@@ -2,6 +2,7 @@ package pkg
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -47,9 +48,19 @@ func (d DirFS) Sub(dir string) (f fs.FS, err error) {
 }
 
 func (d DirFS) CreateAll(name string) (w io.WriteCloser, err error) {
+	return d.create(name, false)
+}
+
+// CreateNew is CreateAll failing with os.ErrExist if name exists, even if
+// it is created meanwhile.
+func (d DirFS) CreateNew(name string) (w io.WriteCloser, err error) {
+	return d.create(name, true)
+}
+
+func (d DirFS) create(name string, excl bool) (w io.WriteCloser, err error) {
 	defer func() {
 		if err != nil {
-			err = fmt.Errorf("create %q: %s", name, err)
+			err = fmt.Errorf("create %q: %w", name, err)
 		}
 	}()
 
@@ -58,17 +69,178 @@ func (d DirFS) CreateAll(name string) (w io.WriteCloser, err error) {
 		return
 	}
 
-	var f *os.File
-	if f, err = os.Create(filepath.Join(string(d), name)); err != nil {
-		return
+	return createAtomic(filepath.Join(string(d), name), excl)
+}
+
+// atomicFile is a temporary file renamed to name on Close, so that name is
+// never left partially written. If a write failed, Close removes the
+// temporary file and keeps name untouched.
+type atomicFile struct {
+	*os.File
+	name string
+	err  error
+
+	// name was created empty, reserved for the rename
+	reserved bool
+
+	// File is name itself, a special file like /dev/stdout
+	inPlace bool
+}
+
+// createAtomic creates the atomic file of name, with the mode of name if it
+// exists, or the default one, of the umask. With excl, it fails if name
+// exists. The special files, like /dev/stdout, are written in place.
+func createAtomic(name string, excl bool) (f *atomicFile, err error) {
+	info, statErr := os.Stat(name)
+	if statErr == nil && !excl && !info.Mode().IsRegular() {
+		var file *os.File
+		if file, err = os.OpenFile(name, os.O_WRONLY|os.O_TRUNC, 0); err != nil {
+			return
+		}
+		return &atomicFile{File: file, name: name, inPlace: true}, nil
 	}
-	return f, nil
+
+	f = &atomicFile{name: name}
+	if statErr != nil || excl {
+		// name is created empty, so that it gets the default mode
+		var reserved *os.File
+		if reserved, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666); err == nil {
+			f.reserved = true
+			info, err = reserved.Stat()
+			reserved.Close()
+		} else if !excl && os.IsExist(err) {
+			// created meanwhile
+			info, err = os.Stat(name)
+		}
+		if err != nil {
+			f.remove()
+			return nil, err
+		}
+	}
+
+	var tmp *os.File
+	if tmp, err = os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*"); err != nil {
+		f.remove()
+		return nil, err
+	}
+	f.File = tmp
+	if err = tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		f.remove()
+		return nil, err
+	}
+	return
+}
+
+// remove removes the temporary file, and name if it was reserved.
+func (f *atomicFile) remove() {
+	if f.File != nil {
+		os.Remove(f.File.Name())
+	}
+	if f.reserved {
+		os.Remove(f.name)
+	}
+}
+
+// Abort closes the file and discards what was written, keeping name
+// untouched, unless it is written in place.
+func (f *atomicFile) Abort() {
+	f.File.Close()
+	if !f.inPlace {
+		f.remove()
+	}
+}
+
+func (f *atomicFile) Write(p []byte) (n int, err error) {
+	if n, err = f.File.Write(p); err != nil && f.err == nil {
+		f.err = err
+	}
+	return
+}
+
+func (f *atomicFile) Close() (err error) {
+	if err = f.File.Close(); err == nil {
+		if err = f.err; err == nil {
+			if f.inPlace {
+				return
+			}
+			if err = os.Rename(f.File.Name(), f.name); err == nil {
+				return
+			}
+		}
+	}
+	if !f.inPlace {
+		f.remove()
+	}
+	return
 }
 
 type PathFS struct {
 	FS      FS
 	Dir     string
 	RootDir string
+
+	// IncludePrefix starts the include lines. Defaults to DefaultIncludePrefix.
+	// The code includes start with it too, trimmed and followed by `code `,
+	// as in `::code`.
+	IncludePrefix string
+
+	// ExpandEnv expands the environment variables, like `$PROJECT_ROOT`, in
+	// the paths of the `:: ` and `::code` includes.
+	ExpandEnv bool
+
+	// IgnoreMissingIncludes replaces the missing included files by a
+	// `% MISSING INCLUDE: path` LaTeX comment instead of failing.
+	IgnoreMissingIncludes bool
+
+	// LogWriter receives the included files log. Defaults to os.Stderr.
+	LogWriter io.Writer
+
+	// WarningWriter receives the warnings, like the missing includes.
+	// Defaults to the LogWriter.
+	WarningWriter io.Writer
+
+	// Stdin is read for the `-` file. Its includes are relative to Dir.
+	// Defaults to os.Stdin.
+	Stdin io.Reader
+}
+
+func (c *PathFS) logWriter() io.Writer {
+	if c.LogWriter == nil {
+		return stderr
+	}
+	return c.LogWriter
+}
+
+func (c *PathFS) warningWriter() io.Writer {
+	if c.WarningWriter == nil {
+		return c.logWriter()
+	}
+	return c.WarningWriter
+}
+
+// DefaultIncludePrefix is the default prefix of the include lines, as in
+// `:: path/to/file.md`.
+const DefaultIncludePrefix = ":: "
+
+// expand expands the environment variables in pth if ExpandEnv is set.
+func (c *PathFS) expand(pth string) string {
+	if c.ExpandEnv {
+		return os.ExpandEnv(pth)
+	}
+	return pth
+}
+
+func (c *PathFS) includePrefix() string {
+	if c.IncludePrefix == "" {
+		return DefaultIncludePrefix
+	}
+	return c.IncludePrefix
+}
+
+// codePrefix returns the prefix of the code include lines, like `::code `.
+func (c *PathFS) codePrefix() string {
+	return strings.TrimSpace(c.includePrefix()) + "code "
 }
 
 func (c *PathFS) pathOf(name string) string {
@@ -94,50 +266,172 @@ func (c PathFS) Sub(name string) (sub *PathFS, err error) {
 
 func (c *PathFS) ReadFile(out io.Writer, pth string) error {
 	var count int
-	return c.readFile(out, pth, &count, 0)
+	return c.readFile(out, pth, lineRange{}, &count, nil)
 }
 
 func (c *PathFS) CreateAll(name string) (w io.WriteCloser, err error) {
 	return c.FS.CreateAll(c.pathOf(name))
 }
 
+// CreateNew is CreateAll failing with os.ErrExist if name exists. Only the
+// FS having a CreateNew method, as DirFS, check it when creating the file.
+func (c *PathFS) CreateNew(name string) (w io.WriteCloser, err error) {
+	if fs, ok := c.FS.(interface {
+		CreateNew(name string) (io.WriteCloser, error)
+	}); ok {
+		return fs.CreateNew(c.pathOf(name))
+	}
+	if c.exists(name) {
+		return nil, &os.PathError{Op: "create", Path: name, Err: os.ErrExist}
+	}
+	return c.CreateAll(name)
+}
+
+// exists reports whether the file name exists.
+func (c *PathFS) exists(name string) bool {
+	if dir, ok := c.FS.(DirFS); ok {
+		_, err := os.Lstat(filepath.Join(string(dir), c.pathOf(name)))
+		return err == nil
+	}
+	f, err := c.FS.Open(c.pathOf(name))
+	if err == nil {
+		f.Close()
+	}
+	return err == nil
+}
+
 func (c *PathFS) Open(name string) (fs.File, error) {
 	return c.FS.Open(filepath.Join(c.Dir, name))
 }
 
-func (c *PathFS) readFile(out io.Writer, pth string, count *int, depth int) (err error) {
+// lineRange is the `#Lstart-Lend` suffix of an include, 1-based and
+// inclusive. The zero value is the whole file.
+type lineRange struct {
+	start, end int
+}
+
+func (r lineRange) String() string {
+	return fmt.Sprintf("L%d-L%d", r.start, r.end)
+}
+
+func (r lineRange) contains(ln int) bool {
+	return r.start == 0 || ln >= r.start && ln <= r.end
+}
+
+// parseInclude splits the `:: ` directive argument into the path and the
+// optional line range.
+func parseInclude(arg string) (pth string, lines lineRange, err error) {
+	pos := strings.LastIndex(arg, "#L")
+	if pos < 0 {
+		return arg, lines, nil
+	}
+	var r lineRange
+	if n, _ := fmt.Sscanf(arg[pos+1:], "L%d-L%d", &r.start, &r.end); n != 2 || arg[pos+1:] != r.String() {
+		// not a range, but part of the file name
+		return arg, lines, nil
+	}
+	if r.start < 1 || r.end < r.start {
+		return "", lines, fmt.Errorf("%s: invalid line range %s", arg[:pos], r)
+	}
+	return arg[:pos], r, nil
+}
+
+// readFile writes the file pth to out, with its includes. Only the lines in
+// the range are written, unless it is the zero value. The stack holds the
+// paths of the files being included, to detect include cycles.
+func (c *PathFS) readFile(out io.Writer, pth string, lines lineRange, count *int, stack []string) (err error) {
 	(*count)++
 
-	var f fs.File
+	var (
+		r     io.Reader
+		depth = len(stack)
+		full  = path.Join(c.Dir, pth)
+	)
+
+	for i, p := range stack {
+		if p == full {
+			return fmt.Errorf("include cycle: %s", strings.Join(append(stack[i:], full), " -> "))
+		}
+	}
+	stack = append(stack, full)
 
 	if depth == 0 {
-		fmt.Fprintf(os.Stderr, "include %03d: %s: %s\n", *count, c.Dir, pth)
+		fmt.Fprintf(c.logWriter(), "include %03d: %s: %s\n", *count, c.Dir, pth)
 	} else {
-		fmt.Fprintf(os.Stderr, "include %s %03d: %s: %s\n", strings.Repeat("--", depth), *count, c.Dir, pth)
+		fmt.Fprintf(c.logWriter(), "include %s %03d: %s: %s\n", strings.Repeat("--", depth), *count, c.Dir, pth)
 	}
 
-	if f, err = c.Open(pth); err != nil {
-		return
+	if pth == "-" && depth == 0 {
+		if r = c.Stdin; r == nil {
+			r = os.Stdin
+		}
+	} else {
+		var f fs.File
+		if f, err = c.Open(pth); err != nil {
+			if depth > 0 && c.IgnoreMissingIncludes && errors.Is(err, fs.ErrNotExist) {
+				fmt.Fprintf(c.warningWriter(), "warning: missing include %s\n", full)
+				// raw latex block, see the HtmlBlockHandler of Exec
+				_, err = io.WriteString(out, "<!-- ::\n% MISSING INCLUDE: "+full+"\n-->\n")
+			}
+			return
+		}
+		defer f.Close()
+		r = f
 	}
 
-	scanner := bufio.NewScanner(f)
+	scanner := bufio.NewScanner(r)
 	scanner.Split(bufio.ScanLines)
 
 	var (
 		rline, prev string
 		ln          int
+		prefix      = c.includePrefix()
+		codePrefix  = c.codePrefix()
+		// the fence of the open code block, whose lines are not directives
+		fence string
 	)
 
 	for scanner.Scan() {
-		ln++
+		if ln++; !lines.contains(ln) {
+			if ln > lines.end {
+				break
+			}
+			continue
+		}
 		rline = scanner.Text()
-		if line := strings.TrimSpace(rline); strings.HasPrefix(line, ":: ") && prev == "" {
-			npth := strings.TrimSpace(line[2:])
-			var sub *PathFS
+		line := strings.TrimSpace(rline)
+		if fence != "" {
+			if strings.HasPrefix(line, fence) && strings.Trim(line, fence[:1]) == "" {
+				fence = ""
+			}
+			out.Write([]byte(rline))
+			out.Write([]byte("\n"))
+		} else if fence = codeFence(line); fence != "" {
+			out.Write([]byte(rline))
+			out.Write([]byte("\n"))
+		} else if class, ok := fencedDiv(line); ok {
+			if class == "" {
+				out.Write([]byte("\n<!-- /div -->\n\n"))
+			} else {
+				out.Write([]byte("\n<!-- div " + class + " -->\n\n"))
+			}
+		} else if strings.HasPrefix(line, codePrefix) && prev == "" {
+			if err = c.readCode(out, strings.Fields(line[len(codePrefix):])); err != nil {
+				return fmt.Errorf("from %s#%d: %s", pth, ln, err)
+			}
+		} else if strings.HasPrefix(line, prefix) && prev == "" {
+			var (
+				npth   string
+				nlines lineRange
+				sub    *PathFS
+			)
+			if npth, nlines, err = parseInclude(c.expand(strings.TrimSpace(line[len(prefix):]))); err != nil {
+				return fmt.Errorf("from %s#%d: %s", pth, ln, err)
+			}
 			if sub, err = c.Sub(path.Dir(npth)); err != nil {
 				return
 			}
-			if err = sub.readFile(out, path.Base(npth), count, depth+1); err != nil {
+			if err = sub.readFile(out, path.Base(npth), nlines, count, stack); err != nil {
 				return fmt.Errorf("from %s#%d: %s", pth, ln, err)
 			}
 			out.Write([]byte("\n"))
@@ -147,6 +441,92 @@ func (c *PathFS) readFile(out io.Writer, pth string, count *int, depth int) (err
 		}
 		prev = rline
 	}
+	if lines.start != 0 && ln < lines.end {
+		return fmt.Errorf("%s: line range %s out of range, the file has %d lines", pth, lines, ln)
+	}
+	return
+}
+
+// readCode writes the file of the `::code [LANG] PATH` directive args to out
+// verbatim, as a fenced code block of the language LANG. The path accepts the
+// `#Lstart-Lend` line range suffix.
+func (c *PathFS) readCode(out io.Writer, args []string) (err error) {
+	var lang, arg string
+	switch len(args) {
+	case 1:
+		arg = args[0]
+	case 2:
+		lang, arg = args[0], args[1]
+	default:
+		return fmt.Errorf("invalid code include %q, want `%s[LANG] PATH`", strings.Join(args, " "), c.codePrefix())
+	}
+
+	pth, lines, err := parseInclude(c.expand(arg))
+	if err != nil {
+		return
+	}
+	var f fs.File
+	if f, err = c.FS.Open(c.pathOf(pth)); err != nil {
+		return
+	}
 	defer f.Close()
+
+	var (
+		code    strings.Builder
+		ln      int
+		scanner = bufio.NewScanner(f)
+	)
+	for scanner.Scan() {
+		if ln++; lines.contains(ln) {
+			code.WriteString(scanner.Text())
+			code.WriteString("\n")
+		} else if ln > lines.end {
+			break
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+	if lines.start != 0 && ln < lines.end {
+		return fmt.Errorf("%s: line range %s out of range, the file has %d lines", pth, lines, ln)
+	}
+
+	// the fence must be longer than the backtick runs of the code
+	fence := "```"
+	for strings.Contains(code.String(), fence) {
+		fence += "`"
+	}
+	_, err = io.WriteString(out, "\n"+fence+lang+"\n"+code.String()+fence+"\n\n")
 	return
 }
+
+// codeFence returns the opening fence of the fenced code block line, like
+// "```" in "```go", or "" if it isn't one.
+func codeFence(line string) string {
+	if !strings.HasPrefix(line, "```") && !strings.HasPrefix(line, "~~~") {
+		return ""
+	}
+	return line[:len(line)-len(strings.TrimLeft(line, line[:1]))]
+}
+
+// fencedDiv parses pandoc style fenced div fences (`::: warning`,
+// `::: {.warning}`) and returns its class. The closing fence (`:::`) has an
+// empty class.
+func fencedDiv(line string) (class string, ok bool) {
+	if !strings.HasPrefix(line, ":::") {
+		return
+	}
+	class = strings.TrimSpace(strings.Trim(line, ":"))
+	if strings.HasPrefix(class, "{") && strings.HasSuffix(class, "}") {
+		for _, attr := range strings.Fields(class[1 : len(class)-1]) {
+			if strings.HasPrefix(attr, ".") {
+				return attr[1:], true
+			}
+		}
+		return "", false
+	}
+	if strings.ContainsAny(class, " \t") {
+		return "", false
+	}
+	return class, true
+}
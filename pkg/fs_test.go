@@ -0,0 +1,213 @@
+package pkg
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDirFSCreateAllWriteError(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"out/doc.tex": "original"})
+
+	w, err := DirFS(dir).CreateAll("out/doc.tex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write([]byte("partial")); err != nil {
+		t.Fatal(err)
+	}
+	// fail the next write
+	w.(*atomicFile).File.Close()
+	if _, err = w.Write([]byte("rest")); err == nil {
+		t.Fatal("write to a closed file succeeded")
+	}
+	if err = w.Close(); err == nil {
+		t.Error("Close succeeded after a failed write")
+	}
+
+	if got := readFile(t, filepath.Join(dir, "out/doc.tex")); got != "original" {
+		t.Errorf("got %q, want the original file", got)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "out", ".doc.tex.*")); len(matches) > 0 {
+		t.Errorf("temporary files left: %v", matches)
+	}
+}
+
+func TestDirFSCreateAll(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := DirFS(dir).CreateAll("a/b/doc.tex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readFile(t, filepath.Join(dir, "a/b/doc.tex")); got != "data" {
+		t.Errorf("got %q, want %q", got, "data")
+	}
+}
+
+func TestPathFSReadFileIncludeCycle(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.md":     "A\n\n:: sub/b.md\n",
+		"sub/b.md": "B\n\n:: /a.md\n",
+	})
+
+	c := PathFS{RootDir: dir, FS: DirFS(dir)}
+	err := c.ReadFile(io.Discard, "a.md")
+	if err == nil || !strings.Contains(err.Error(), "include cycle: a.md -> sub/b.md -> a.md") {
+		t.Errorf("got error %v, want an include cycle", err)
+	}
+}
+
+func TestPathFSReadFileLineRange(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.md":      "A\n\n:: shared.md#L2-L3\n",
+		"b.md":      "B\n\n:: shared.md#L3-L5\n",
+		"shared.md": "one\ntwo\nthree\nfour\n",
+	})
+
+	c := PathFS{RootDir: dir, FS: DirFS(dir)}
+	var out strings.Builder
+	if err := c.ReadFile(&out, "a.md"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "A\n\ntwo\nthree\n\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	err := c.ReadFile(io.Discard, "b.md")
+	if err == nil || !strings.Contains(err.Error(), "shared.md: line range L3-L5 out of range") {
+		t.Errorf("got error %v, want an out of range error", err)
+	}
+}
+
+func TestPathFSReadFileCode(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"doc.md":      "Code:\n\n::code go src/main.go\n\n::code src/doc.md#L2-L2\n",
+		"src/main.go": "package main\n\nfunc main() {}\n",
+		"src/doc.md":  "Text\n```sh\n",
+	})
+
+	c := PathFS{RootDir: dir, FS: DirFS(dir)}
+	var out strings.Builder
+	if err := c.ReadFile(&out, "doc.md"); err != nil {
+		t.Fatal(err)
+	}
+	want := "Code:\n\n\n```go\npackage main\n\nfunc main() {}\n```\n\n\n\n````\n```sh\n````\n\n"
+	if got := out.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestPathFSReadFileCodeFence(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"doc.md": "````md\n::: warning\n\n:: a.md\n\n::code a.md\n```\n````\n\n:: a.md\n",
+		"a.md":   "A\n",
+	})
+
+	c := PathFS{RootDir: dir, FS: DirFS(dir)}
+	var out strings.Builder
+	if err := c.ReadFile(&out, "doc.md"); err != nil {
+		t.Fatal(err)
+	}
+	want := "````md\n::: warning\n\n:: a.md\n\n::code a.md\n```\n````\n\nA\n\n"
+	if got := out.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestPathFSReadFileExpandEnv(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"doc.md":          ":: $PARTS_DIR/a.md\n",
+		"parts/a.md":      "A\n",
+		"$PARTS_DIR/a.md": "literal\n",
+	})
+	os.Setenv("PARTS_DIR", "parts")
+	defer os.Unsetenv("PARTS_DIR")
+
+	for _, v := range []struct {
+		expand bool
+		want   string
+	}{
+		{false, "literal\n\n"},
+		{true, "A\n\n"},
+	} {
+		c := PathFS{RootDir: dir, FS: DirFS(dir), ExpandEnv: v.expand}
+		var out strings.Builder
+		if err := c.ReadFile(&out, "doc.md"); err != nil {
+			t.Fatal(err)
+		}
+		if got := out.String(); got != v.want {
+			t.Errorf("ExpandEnv=%v: got %q, want %q", v.expand, got, v.want)
+		}
+	}
+}
+
+func TestDirFSCreateAllMode(t *testing.T) {
+	dir := t.TempDir()
+	ref, err := os.OpenFile(filepath.Join(dir, "ref"), os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref.Close()
+	writeFiles(t, dir, map[string]string{"old.tex": "old"})
+	if err = os.Chmod(filepath.Join(dir, "old.tex"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{"new.tex": "ref", "old.tex": "old.tex"} {
+		w, err := DirFS(dir).CreateAll(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		got, _ := os.Stat(filepath.Join(dir, name))
+		wantInfo, _ := os.Stat(filepath.Join(dir, want))
+		if got.Mode() != wantInfo.Mode() {
+			t.Errorf("%s: got mode %v, want %v", name, got.Mode(), wantInfo.Mode())
+		}
+	}
+}
+
+func TestCreateAtomicAbort(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"old.tar": "old"})
+
+	for _, name := range []string{"old.tar", "new.tar"} {
+		pth := filepath.Join(dir, name)
+		f, err := createAtomic(pth, name == "new.tar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = f.Write([]byte("partial")); err != nil {
+			t.Fatal(err)
+		}
+		f.Abort()
+	}
+
+	if got := readFile(t, filepath.Join(dir, "old.tar")); got != "old" {
+		t.Errorf("got %q, want the original file", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new.tar")); !os.IsNotExist(err) {
+		t.Errorf("aborted new file left: %v", err)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, ".*.tar.*")); len(matches) > 0 {
+		t.Errorf("temporary files left: %v", matches)
+	}
+}
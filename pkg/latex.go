@@ -8,31 +8,285 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"net/url"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 	"unicode/utf8"
-	"unsafe"
 
 	bf "github.com/russross/blackfriday/v2"
 	"github.com/shopspring/decimal"
 )
 
+// Author is a document author.
+type Author struct {
+	Name string
+
+	// Affiliation is rendered as a `\thanks` footnote of the name.
+	Affiliation string
+}
+
 type Opts struct {
 
 	// Flags allow customizing this renderer's behavior.
 	Flags Flag
 
+	// The document title. When set, it is preferred over the titleblock.
+	Title string
+
+	// The document date displayed by the `\maketitle` command. When empty,
+	// LaTeX displays `\today`; DateNone displays no date at all.
+	Date string
+
+	// DateFormat is the Go time layout of the DateToday date.
+	DateFormat string
+
+	// Now is the time of the DateToday date. Defaults to time.Now().
+	Now time.Time
+
+	// The document abstract, as plain text. Only rendered when CompletePage is
+	// on.
+	Abstract string
+
+	// Keywords are listed with `\keywords` after the abstract.
+	Keywords []string
+
+	// TOCDepth sets the deepest heading level listed in the table of contents
+	// (`\setcounter{tocdepth}`). Zero or negative keeps the LaTeX default.
+	TOCDepth int
+
+	// SecNumDepth sets the deepest numbered heading level
+	// (`\setcounter{secnumdepth}`). Zero or negative keeps the LaTeX default.
+	SecNumDepth int
+
+	// Columns is the number of columns of the body of the complete pages,
+	// typeset by the `multicols` of multicol when greater than 1, within the
+	// BodyEnvironment. The title and the table of contents span the columns,
+	// as do the `figure*` of the titled images; the tables and the other
+	// images take the `\linewidth` of a column.
+	Columns int
+
+	// BodyEnvironment is the environment, like `multicols`, wrapping the body
+	// of the complete pages, after the title and the table of contents. Its
+	// package is not loaded.
+	BodyEnvironment string
+
+	// BodyEnvironmentArgs are the arguments of BodyEnvironment, like `2` of
+	// `\begin{multicols}{2}`.
+	BodyEnvironmentArgs []string
+
+	// FloatBarriers ends the top-level sections with the `\FloatBarrier` of
+	// placeins, keeping the figures and the tables within their section.
+	FloatBarriers bool
+
+	// NumberWithinSection numbers the figures and the tables within the
+	// sections, as in `Figure 3.2`, with the `\numberwithin` of amsmath.
+	NumberWithinSection bool
+
+	// AbstractHeading is the text of the top-level heading whose section is
+	// rendered as the abstract when Abstract is empty. Defaults to `Abstract`.
+	AbstractHeading string
+
+	// BibResource is the `.bib` file of the biblatex bibliography. When set,
+	// the BibliographyHeading heading is replaced by the `\printbibliography`
+	// of it, and the lists of its section are dropped.
+	BibResource string
+
+	// BibliographyHeading is the text of the heading whose section, up to the
+	// next heading of the same or upper level, is the bibliography. Defaults to
+	// DefaultBibliographyHeading.
+	BibliographyHeading string
+
+	// AbstractBeforeTOC places the abstract before the table of contents
+	// instead of after it.
+	AbstractBeforeTOC bool
+
 	// The document author displayed by the `\maketitle` command.
 	// This will only display if the `Titleblock` extension is on and a title is
 	// present.
 	Author string
 
+	// Authors lists the document authors, joined with `\and`. Author is a
+	// shortcut for a single author without affiliation.
+	Authors []Author
+
 	// The languages to be used by the `babel` package.
 	// Languages must be comma-spearated.
 	Languages string
 
+	// MainLanguage is the main document language, a babel language name like
+	// `english`. Defaults to the last of Languages, as in babel.
+	MainLanguage string
+
+	// LanguageQuotes renders the block quotes with the quotation marks of the
+	// MainLanguage (`foreigndisplayquote` of csquotes) instead of EnvQuotation.
+	LanguageQuotes bool
+
 	EnvQuotation string
 
+	// EnvQuotationAttributed is the command of the quotes ending with a
+	// `-- Author` line, called as `\cmd{quote}{author}` (e.g. `epigraph`).
+	// When empty, they are rendered with EnvQuotation.
+	EnvQuotationAttributed string
+
+	// DivEnvironments maps fenced div classes (`::: warning`) to LaTeX
+	// environments. Divs of unmapped classes render their content only.
+	DivEnvironments map[string]string
+
+	// FragmentTitle controls how the titleblock is rendered when CompletePage
+	// is off. The ChapterTitle flag takes precedence over it.
+	FragmentTitle FragmentTitle
+
+	// ListingName replaces the `Listing` label of the code captions.
+	ListingName string
+
+	// ListingUnnumbered drops the number of the code captions labels.
+	ListingUnnumbered bool
+
+	// DefinitionListAsTable renders the definition lists as two columns tables
+	// of terms and definitions instead of `description` environments.
+	DefinitionListAsTable bool
+
+	// TrimCodeBlankLines strips the leading and trailing blank lines of code
+	// blocks.
+	TrimCodeBlankLines bool
+
+	// FootnotesAsEndSection renders footnotes as endnotes: references become
+	// superscript numbers and the notes are listed in a `Notes` section at the
+	// end of the document.
+	FootnotesAsEndSection bool
+
+	// BracketedFootnoteMarks renders the footnote references as bracketed
+	// superscript numbers, like `[1]`, instead of the LaTeX marks. The notes
+	// are still rendered at the bottom of the page.
+	BracketedFootnoteMarks bool
+
+	// HeadingMap replaces the heading level to command mapping: the level N
+	// heading is rendered with the command HeadingMap[N-1]. Levels beyond it
+	// are rendered in bold.
+	HeadingMap []string
+
+	// UnnumberedSections renders every heading starred, still listed in the
+	// table of contents. The per-heading config takes precedence over it.
+	UnnumberedSections bool
+
+	// HeadingOffset shifts the heading levels, e.g. with 1 `#` is rendered as
+	// the level 2 heading.
+	HeadingOffset int
+
+	// ShortenAutolinks displays the autolinks by the domain of the URL only,
+	// still targeting the full URL.
+	ShortenAutolinks bool
+
+	// BeginDocumentHook is raw LaTeX written right after `\begin{document}`,
+	// before the title, e.g. to insert a logo or a title page.
+	BeginDocumentHook string
+
+	// Engine is the LaTeX engine the document is written for.
+	Engine Engine
+
+	// MainFont is the `\setmainfont` system font of the unicode engines.
+	// Ignored by EnginePDFLaTeX.
+	MainFont string
+
+	// PassthroughLanguages are the languages of the code blocks written
+	// literally, to be drawn instead of listed, like `tikz`. Defaults to
+	// DefaultPassthroughLanguages.
+	PassthroughLanguages []string
+
+	// DollarMath renders the `$...$` spans of the text as inline math, as
+	// pandoc does. `\$` is a literal dollar.
+	DollarMath bool
+
+	// BreakURLs breaks the URLs of `\href`, `\url` and `\nolinkurl`
+	// anywhere, as after `/`, `.`, `?` or `&`, with the xurl package, so that
+	// long URLs don't overflow the margin. Run and the command line tool turn
+	// it on by default.
+	BreakURLs bool
+
+	// ParSkip is the space between paragraphs, like `6pt plus 2pt`, or
+	// ParSkipPackage. Defaults to half a line more than the class.
+	ParSkip string
+
+	// ParIndent is the first line indent of the paragraphs, like `1.5em`.
+	// `0pt` is the NoParIndent flag. Defaults to the class indent.
+	ParIndent string
+
+	// PreambleTemplate replaces the generated preamble, between
+	// `\documentclass` and `\begin{document}`. Its `{{title}}`, `{{author}}`
+	// and `{{languages}}` tokens are substituted. The options of the generated
+	// preamble, like GeometryOptions or HyperrefOptions, are then ignored.
+	PreambleTemplate string
+
+	// GeometryOptions are the options of the geometry package, like
+	// `a4paper,left=2cm,right=2cm`. Defaults to DefaultGeometryOptions;
+	// GeometryNone doesn't load the package.
+	GeometryOptions string
+
+	// HyperrefOptions are merged over the default hyperref options, which
+	// color all the links black, e.g. `linkcolor: blue`. The empty values are
+	// bare keys, like `colorlinks`.
+	HyperrefOptions map[string]string
+
+	// TableBorderPreset sets the borders of the tables that don't set their
+	// own: `all`, `none`, `outer` or `horizontal`. The `table-border PRESET`
+	// directive changes it for the following tables.
+	TableBorderPreset string
+
+	// TableAutoWidth renders the tables as `tabularx` of the text width, with
+	// equal flexible width columns, but for the columns of explicit width.
+	TableAutoWidth bool
+
+	// TableZebra shades the table rows alternately with TableZebraColors,
+	// from the second row.
+	TableZebra bool
+
+	// TableZebraColors are the xcolor colors of the even and odd rows. The
+	// empty ones default to the DefaultTableZebraColors.
+	TableZebraColors [2]string
+
+	// Highlight renders the `==...==` spans of the text as the `\hl` of soul,
+	// in HighlightColor.
+	Highlight bool
+
+	// HighlightColor is the xcolor color of the highlights, set by
+	// `\sethlcolor`. Defaults to the yellow of soul.
+	HighlightColor string
+
+	// EnableColorSpans renders the `<span style="color:red">` spans as
+	// `\textcolor` and the `<mark>` spans as the `\hl` of soul.
+	EnableColorSpans bool
+
+	// HardbreakCommand is the LaTeX of the hard line breaks, like `\\` or
+	// `\newline`. Defaults to DefaultHardbreakCommand.
+	HardbreakCommand string
+
+	// HorizontalRuleCommand is the LaTeX of the horizontal rules. Defaults to
+	// DefaultHorizontalRuleCommand, whose `\HRule` the preamble defines.
+	HorizontalRuleCommand string
+
+	// HRuleAsNewPage renders the horizontal rules as `\newpage`, for the
+	// slide-like documents using `---` between the pages.
+	HRuleAsNewPage bool
+
+	// EmailCommand is the command, like `texttt` or `email`, wrapping the
+	// displayed address of the email autolinks. Unless it is `texttt`, it is
+	// provided as `\texttt` when the document class lacks it.
+	EmailCommand string
+
+	// RelativeLinksAsText renders the links to relative destinations, which
+	// don't resolve in a PDF, as their plain text instead of `\href`.
+	RelativeLinksAsText bool
+
+	// TrustedProtocols are the URL schemes linked under the Safelink flag,
+	// e.g. `ftp` or `tel`. Defaults to DefaultTrustedProtocols.
+	TrustedProtocols []string
+
+	// EmojiMode controls how emoji shortcodes like `:smile:` are rendered.
+	EmojiMode EmojiMode
+
 	Titled bool
 
 	HtmlBlockHandler func(r *Renderer, w io.Writer, node *bf.Node, entering bool) bf.WalkStatus
@@ -51,6 +305,21 @@ func WriteRune(w io.Writer, r rune) (n int, err error) {
 	return w.Write([]byte(string(r)))
 }
 
+// errWriter keeps the first error returned by w and discards every write
+// after it.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) Write(p []byte) (n int, err error) {
+	if ew.err != nil {
+		return 0, ew.err
+	}
+	n, ew.err = ew.w.Write(p)
+	return n, ew.err
+}
+
 // Renderer is a type that implements the Renderer interface for LaTeX
 // output.
 type Renderer struct {
@@ -59,15 +328,127 @@ type Renderer struct {
 	// If text is within quotes.
 	quoted    bool
 	quoteOpen bool
+
+	// Environments of the open fenced divs.
+	divs []string
+
+	// The HtmlBlockHandler writes raw LaTeX for the `<!-- ::` blocks only, as
+	// the one of Exec. Otherwise, it may write some for any HTML.
+	rawBlocksOnly bool
+
+	// Nodes already rendered by the header.
+	skip map[*bf.Node]bool
+
+	// The abstract rendered from the AbstractHeading section.
+	abstract []byte
+
+	// The markdown source of the document, set by Exec and Run, for the
+	// start numbers of the ordered lists, see listStarts. Without it, the
+	// ordered lists start at 1.
+	source []byte
+
+	// The start numbers of the ordered lists.
+	starts []int
+
+	// The ordered lists rendered.
+	orderedLists int
+
+	// The BibliographyHeading heading, see findBibliography.
+	bibliography *bf.Node
+
+	// If a top-level section was rendered, see FloatBarriers.
+	sectionOpen bool
+
+	// The issues found while rendering, see Warnings.
+	warnings []string
+
+	// The LaTeX closing the open color spans.
+	spans []string
+
+	// The borders of the table being rendered.
+	tableBorder tableBorder
+}
+
+// Warnings returns the issues found while rendering, like relative links.
+func (r *Renderer) Warnings() []string {
+	return r.warnings
+}
+
+// isEmailAutolink tells whether the link displays its own mailto address, as
+// the email autolinks do.
+func isEmailAutolink(node *bf.Node) bool {
+	if node.FirstChild == nil || node.FirstChild != node.LastChild || node.FirstChild.Type != bf.Text {
+		return false
+	}
+	addr := string(node.FirstChild.Literal)
+	dest := string(node.LinkData.Destination)
+	return dest == "mailto:"+addr || dest == "mailto://"+addr
+}
+
+// isRelativeLink tells whether dest has no scheme and isn't an anchor.
+func isRelativeLink(dest []byte) bool {
+	if len(dest) == 0 || dest[0] == '#' {
+		return false
+	}
+	u, err := url.Parse(string(dest))
+	return err == nil && u.Scheme == ""
 }
 
 func NewRenderer(opts Opts) *Renderer {
 	if opts.EnvQuotation == "" {
 		opts.EnvQuotation = "quotation"
 	}
+	if opts.AbstractHeading == "" {
+		opts.AbstractHeading = "Abstract"
+	}
 	return &Renderer{Opts: opts}
 }
 
+// Validate returns the first error of the options, like a HeadingMap entry
+// that isn't a command name. NewRenderer doesn't check them: Exec does.
+func (opts *Opts) Validate() error {
+	if max := len(headers) + opts.HeadingOffset; len(opts.HeadingMap) > max {
+		return fmt.Errorf("heading map: %d commands, but the headings have %d levels at most", len(opts.HeadingMap), max)
+	}
+	for i, cmd := range opts.HeadingMap {
+		if !isCommandName(cmd) {
+			return fmt.Errorf("heading map: invalid command %q of the level %d", cmd, i+1)
+		}
+	}
+	if opts.MainLanguage != "" && !isLanguageName(opts.MainLanguage) {
+		return fmt.Errorf("invalid main language %q", opts.MainLanguage)
+	}
+	if _, ok := tableBorderPresets[opts.TableBorderPreset]; !ok && opts.TableBorderPreset != "" {
+		return fmt.Errorf("unknown table border preset %q", opts.TableBorderPreset)
+	}
+	return nil
+}
+
+// isLanguageName reports whether s is a babel language name of letters,
+// digits and hyphens, like `english` or `spanish-mexico`.
+func isLanguageName(s string) bool {
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// isCommandName reports whether s is a LaTeX command name of letters, like
+// `section`.
+func isCommandName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
 // Flag controls the options of the renderer.
 type Flag int
 
@@ -90,6 +471,47 @@ const (
 	TOC // Generate the table of content.
 )
 
+// ParSkipPackage is the Opts.ParSkip value that loads the parskip package,
+// which also drops the paragraph indent.
+const ParSkipPackage = "parskip"
+
+// DefaultGeometryOptions are the default Opts.GeometryOptions.
+const DefaultGeometryOptions = "margin=1in"
+
+// GeometryNone is the Opts.GeometryOptions value that doesn't load the
+// geometry package, to keep the page layout of the document class.
+const GeometryNone = "none"
+
+func (r *Renderer) geometryOptions() string {
+	if r.GeometryOptions == "" {
+		return DefaultGeometryOptions
+	}
+	return r.GeometryOptions
+}
+
+// DateNone is the Opts.Date value that suppresses the date, for reproducible
+// builds.
+const DateNone = "none"
+
+// DateToday is the Opts.Date value resolved to the current date: formatted
+// with DateFormat, or `\today` in the babel language when DateFormat is empty.
+const DateToday = "%TODAY%"
+
+// FragmentTitle controls how the titleblock is rendered when CompletePage is
+// off.
+type FragmentTitle int
+
+const (
+	// FragmentTitleNone drops the title.
+	FragmentTitleNone FragmentTitle = iota
+
+	// FragmentTitleSection renders the title as `\section*{title}`.
+	FragmentTitleSection
+
+	// FragmentTitleBold renders the title as a `\textbf{title}` line.
+	FragmentTitleBold
+)
+
 var cellAlignment = [4]byte{
 	0:                       'l',
 	bf.TableAlignmentLeft:   'l',
@@ -119,18 +541,53 @@ var headers = []string{
 	`subparagraph`,
 }
 
-func (r *Renderer) Escape(w io.Writer, t []byte) {
-	text := []rune(string(t))
+// mainLanguage returns MainLanguage, or the last of Languages.
+func (r *Renderer) mainLanguage() string {
+	if r.MainLanguage != "" {
+		return r.MainLanguage
+	}
+	langs := strings.Split(r.Languages, ",")
+	return strings.TrimSpace(langs[len(langs)-1])
+}
+
+// headers returns the HeadingMap, or the default headers when it is empty.
+func (r *Renderer) headers() []string {
+	if len(r.HeadingMap) > 0 {
+		return r.HeadingMap
+	}
+	return headers
+}
+
+// headingLevel returns the level of the heading node shifted by HeadingOffset.
+func (r *Renderer) headingLevel(node *bf.Node) int {
+	if level := node.Level + r.HeadingOffset; level > 1 {
+		return level
+	}
+	return 1
+}
+
+// latexEscapes is latexEscaper indexed by byte. Every escaped character is
+// ASCII and the bytes of a multi-byte UTF-8 sequence are never ASCII, so the
+// text can be scanned byte by byte without decoding it.
+var latexEscapes [utf8.RuneSelf][]byte
+
+func init() {
+	for c, esc := range latexEscaper {
+		latexEscapes[c] = esc
+	}
+}
+
+func (r *Renderer) Escape(w io.Writer, text []byte) {
 	for i := 0; i < len(text); i++ {
 		// directly copy normal characters
 		org := i
 
-		for i < len(text) && latexEscaper[text[i]] == nil {
+		for i < len(text) && (text[i] >= utf8.RuneSelf || latexEscapes[text[i]] == nil) {
 			i++
 		}
 
 		if i > org {
-			w.Write([]byte(string(text[org:i])))
+			w.Write(text[org:i])
 			if i >= len(text) {
 				break
 			}
@@ -148,8 +605,13 @@ func (r *Renderer) Escape(w io.Writer, t []byte) {
 			}
 		case '\'':
 			if r.quoted {
-				if r.quoteOpen && i < len(text) {
-					switch text[i+1] {
+				if r.quoteOpen {
+					// the end of text closes the quote too
+					next := byte(' ')
+					if i+1 < len(text) {
+						next = text[i+1]
+					}
+					switch next {
 					case '\r', '\n', ' ', '\t', '.':
 						WriteRune(w, '’')
 					}
@@ -175,9 +637,33 @@ func (r *Renderer) Escape(w io.Writer, t []byte) {
 				}
 			}
 		default:
-			w.Write(latexEscaper[text[i]])
+			w.Write(latexEscapes[text[i]])
+		}
+	}
+}
+
+// escapeString escapes s with a fresh quoting state.
+func escapeString(s string) string {
+	var buf bytes.Buffer
+	(&Renderer{}).Escape(&buf, []byte(s))
+	return buf.String()
+}
+
+// trimBlankLines removes the leading and trailing blank lines of code,
+// keeping its final line break.
+func trimBlankLines(code []byte) []byte {
+	for {
+		pos := bytes.IndexByte(code, '\n')
+		if pos < 0 || len(bytes.TrimSpace(code[:pos])) != 0 {
+			break
 		}
+		code = code[pos+1:]
 	}
+	code = bytes.TrimRight(code, " \t\r\n")
+	if len(code) == 0 {
+		return code
+	}
+	return append(code[:len(code):len(code)], '\n')
 }
 
 func languageAttr(info []byte) []byte {
@@ -191,6 +677,81 @@ func languageAttr(info []byte) []byte {
 	return info[:endOfLang]
 }
 
+// infoAttrs parses the `key=value` and `key="quoted value"` attributes that
+// follow the language of the info string of a code block, like
+// `go caption="Main loop" label=lst:main`.
+func infoAttrs(info []byte) map[string]string {
+	attrs := map[string]string{}
+	rest := string(bytes.TrimPrefix(info, languageAttr(info)))
+	for {
+		if rest = strings.TrimLeft(rest, " \t"); rest == "" {
+			return attrs
+		}
+		end := strings.IndexAny(rest, " \t=")
+		if end < 0 {
+			end = len(rest)
+		}
+		key := rest[:end]
+		if rest = rest[end:]; !strings.HasPrefix(rest, "=") {
+			// a flag or an attribute block, like `{#label}`
+			attrs[key] = ""
+			continue
+		}
+		rest = rest[1:]
+		if strings.HasPrefix(rest, `"`) {
+			if end = strings.IndexByte(rest[1:], '"'); end < 0 {
+				attrs[key], rest = rest[1:], ""
+			} else {
+				attrs[key], rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			if end = strings.IndexAny(rest, " \t"); end < 0 {
+				end = len(rest)
+			}
+			attrs[key], rest = rest[:end], rest[end:]
+		}
+	}
+}
+
+// parseLineRanges parses the `hl=1,3-5` code block attribute.
+func parseLineRanges(s string) (ranges []lineRange, err error) {
+	for _, part := range strings.Split(s, ",") {
+		var rg lineRange
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		if rg.start, err = strconv.Atoi(bounds[0]); err != nil {
+			return nil, fmt.Errorf("invalid line %q", bounds[0])
+		}
+		rg.end = rg.start
+		if len(bounds) == 2 {
+			if rg.end, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("invalid line %q", bounds[1])
+			}
+		}
+		if rg.start < 1 || rg.end < rg.start {
+			return nil, fmt.Errorf("invalid line range %q", part)
+		}
+		ranges = append(ranges, rg)
+	}
+	return
+}
+
+// labelAttr returns the label of the `{#label}` attribute of the info string
+// of a code block, like `math {#eq:energy}`.
+func labelAttr(info []byte) string {
+	start := bytes.Index(info, []byte("{#"))
+	if start < 0 {
+		return ""
+	}
+	end := bytes.IndexByte(info[start:], '}')
+	if end < 0 {
+		return ""
+	}
+	if fields := strings.Fields(string(info[start+2 : start+end])); len(fields) > 0 {
+		return fields[0]
+	}
+	return ""
+}
+
 func (r *Renderer) Env(w io.Writer, environment string, entering bool, args ...string) {
 	if entering {
 		WriteString(w, `\begin{`+environment+"}")
@@ -246,39 +807,125 @@ func hasPrefixCaseInsensitive(s, prefix []byte) bool {
 	return true
 }
 
+// Test if tag is a `<br>`, `<br/>` or `<br />` tag.
+func isBreakTag(tag []byte) bool {
+	if !hasPrefixCaseInsensitive(tag, []byte("<br")) {
+		return false
+	}
+	rest := bytes.TrimSpace(tag[3:])
+	return bytes.Equal(rest, []byte(">")) || bytes.Equal(rest, []byte("/>"))
+}
+
+func hasAncestor(node *bf.Node, typ bf.NodeType) bool {
+	for p := node.Parent; p != nil; p = p.Parent {
+		if p.Type == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// Test if node is within the term of a definition list.
+func isTerm(node *bf.Node) bool {
+	for p := node.Parent; p != nil; p = p.Parent {
+		if p.Type == bf.Item {
+			return p.ListFlags&bf.ListTypeTerm != 0
+		}
+	}
+	return false
+}
+
+// quoteAttribution detects the `-- Author` last line of the quote:
+//
+//	> teste
+//	> -- Author
+//
+// It returns the author and, to render the quote without that line, either
+// the node to drop or the literal of its last text node. The AST is left
+// untouched, so that it can be rendered again.
+func quoteAttribution(node *bf.Node) (author string, drop *bf.Node, literal []byte) {
+	if node.LastChild == nil || node.LastChild.Type != bf.Paragraph ||
+		node.LastChild.LastChild == nil || node.LastChild.LastChild.Type != bf.Text {
+		return
+	}
+	text := node.LastChild.LastChild
+	s := string(text.Literal)
+	if pos := strings.LastIndexByte(s, '\n'); pos > 0 {
+		if lastLine := s[pos+1:]; strings.HasPrefix(lastLine, "-- ") {
+			return strings.TrimSpace(lastLine[3:]), nil, text.Literal[:pos]
+		}
+	} else if pos == -1 && strings.HasPrefix(s, "-- ") {
+		// A lone `-- Author` paragraph is not an attribution when nothing
+		// precedes it.
+		if text.Prev != nil {
+			return strings.TrimSpace(s[3:]), text, nil
+		} else if node.LastChild.Prev != nil {
+			return strings.TrimSpace(s[3:]), node.LastChild, nil
+		}
+	}
+	return
+}
+
+// renderAttributedQuote renders the quote node attributed to author, without
+// the drop node and with the literal of its last text node, if not nil.
+func (r *Renderer) renderAttributedQuote(w io.Writer, node *bf.Node, author string, drop *bf.Node, literal []byte) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	text := node.LastChild.LastChild
+	for c := node.FirstChild; c != nil; c = c.Next {
+		c.Walk(func(node *bf.Node, entering bool) bf.WalkStatus {
+			if node == drop {
+				return bf.SkipChildren
+			}
+			if node == text && literal != nil {
+				cp := *node
+				cp.Literal = literal
+				node = &cp
+			}
+			return r.RenderNode(buf, node, entering)
+		})
+	}
+
+	if r.EnvQuotationAttributed != "" {
+		WriteString(w, `\`+r.EnvQuotationAttributed+`{`)
+		w.Write(bytes.TrimSpace(buf.Bytes()))
+		WriteString(w, `}{`+escapeString(author)+"}\n\n")
+		return
+	}
+	if lang := r.mainLanguage(); r.LanguageQuotes && lang != "" {
+		// csquotes' display quote, with the marks of the language.
+		WriteString(w, `\begin{foreigndisplayquote}{`+lang+`}[`+escapeString(author)+"]\n")
+		w.Write(buf.Bytes())
+		r.Env(w, "foreigndisplayquote", false)
+		return
+	}
+	r.Env(w, r.EnvQuotation, true, escapeString(author))
+	w.Write(buf.Bytes())
+	r.Env(w, r.EnvQuotation, false)
+}
+
 // RenderNode renders a single node.
 // As a rule of thumb to enforce consistency, each node is responsible for
 // appending the needed line breaks. Line breaks are never prepended.
 func (r *Renderer) RenderNode(w io.Writer, node *bf.Node, entering bool) bf.WalkStatus {
 	switch node.Type {
 	case bf.BlockQuote:
-		var args []string
-		if entering && node.LastChild.Type == bf.Paragraph && node.LastChild.LastChild.Type == bf.Text {
-			// detech format:
-			// > teste
-			// > -- Author
-			text := node.LastChild.LastChild
-			if len(text.Literal) > 0 {
-				p := unsafe.Pointer(&text.Literal)
-				s := *(*string)(p)
-				if pos := strings.LastIndexByte(s, '\n'); pos > 0 {
-					if lastLine := s[pos+1:]; strings.HasPrefix(lastLine, "-- ") {
-						args = append(args, strings.TrimSpace(lastLine[3:]))
-						text.Literal = text.Literal[0:pos]
-					}
-				} else if pos == -1 && strings.HasPrefix(s, "-- ") {
-					args = append(args, strings.TrimSpace(s[3:]))
-					if text.Prev != nil {
-						text.Prev.Next = nil
-						text.Parent.LastChild = text.Prev
-					} else if node.LastChild.Prev != nil {
-						node.LastChild = node.LastChild.Prev
-						node.LastChild.Next = nil
-					}
-				}
+		if entering {
+			if author, drop, literal := quoteAttribution(node); author != "" {
+				r.renderAttributedQuote(w, node, author, drop, literal)
+				return bf.SkipChildren
+			}
+		}
+		if lang := r.mainLanguage(); r.LanguageQuotes && lang != "" {
+			// csquotes' display quote, with the marks of the language.
+			if entering {
+				WriteString(w, `\begin{foreigndisplayquote}{`+lang+"}\n")
+			} else {
+				r.Env(w, "foreigndisplayquote", false)
 			}
+			break
 		}
-		r.Env(w, r.EnvQuotation, entering, args...)
+		r.Env(w, r.EnvQuotation, entering)
 
 	case bf.Code:
 		// TODO: Reach a consensus for math syntax.
@@ -289,6 +936,11 @@ func (r *Renderer) RenderNode(w io.Writer, node *bf.Node, entering bool) bf.Walk
 			WriteByte(w, '$')
 			break
 		}
+		if isTerm(node) {
+			// 'lstinline' breaks the optional argument of '\item[...]'.
+			WriteString(w, `\texttt{`+escapeString(string(node.Literal))+`}`)
+			break
+		}
 		// 'lstinline' needs an ASCII delimiter that is not in the node content.
 		// TODO: Find a more elegant fallback for when the code lists all ASCII characters.
 		delimiter := getDelimiter(node.Literal)
@@ -303,20 +955,61 @@ func (r *Renderer) RenderNode(w io.Writer, node *bf.Node, entering bool) bf.Walk
 
 	case bf.CodeBlock:
 		lang := languageAttr(node.Info)
+		code := node.Literal
+		if r.TrimCodeBlankLines {
+			code = trimBlankLines(code)
+		}
 		if bytes.Compare(lang, []byte("math")) == 0 {
+			if label := labelAttr(node.Info); label != "" {
+				// numbered, for \eqref{label}
+				WriteString(w, `\begin{equation}\label{`+label+"}\n")
+				w.Write(code)
+				WriteString(w, `\end{equation}`+"\n\n")
+				break
+			}
 			WriteString(w, "\\[\n")
-			w.Write(node.Literal)
+			w.Write(code)
 			WriteString(w, "\\]\n\n")
 			break
 		}
+		if r.isPassthrough(lang) {
+			renderPassthrough(w, string(lang), code)
+			break
+		}
+		attrs := infoAttrs(node.Info)
 		WriteString(w, `\begin{lstlisting}[language=`)
 		w.Write(lang)
+		if caption, ok := attrs["caption"]; ok {
+			WriteString(w, ",caption={"+escapeString(caption)+"}")
+		}
+		if label, ok := attrs["label"]; ok {
+			WriteString(w, ",label={"+label+"}")
+		}
+		if hl, ok := attrs["hl"]; ok {
+			if ranges, err := parseLineRanges(hl); err != nil {
+				r.warnings = append(r.warnings, fmt.Sprintf("code block hl=%s: %s", hl, err))
+			} else {
+				// see \lsthl in the preamble
+				WriteString(w, ",linebackgroundcolor={")
+				for _, rg := range ranges {
+					WriteString(w, `\lsthl{`+strconv.Itoa(rg.start)+`}{`+strconv.Itoa(rg.end)+`}`)
+				}
+				WriteString(w, "}")
+			}
+		}
 		WriteString(w, "]\n")
-		w.Write(node.Literal)
+		w.Write(code)
 		WriteString(w, `\end{lstlisting}`+"\n\n")
 
 	case bf.Del:
 		r.Cmd(w, "sout", entering)
+		// ulem's \sout breaks on nested formatting, unless boxed.
+		for c := node.FirstChild; c != nil; c = c.Next {
+			if c.Type != bf.Text {
+				r.Cmd(w, "mbox", entering)
+				break
+			}
+		}
 
 	case bf.Document:
 		break
@@ -325,43 +1018,61 @@ func (r *Renderer) RenderNode(w io.Writer, node *bf.Node, entering bool) bf.Walk
 		r.Cmd(w, "emph", entering)
 
 	case bf.Hardbreak:
-		WriteString(w, `~\\`+"\n")
+		WriteString(w, r.hardbreakCommand()+"\n")
 
 	case bf.Heading:
 		if node.IsTitleblock {
 			// Nothing to print but its children.
 			break
 		}
+		if node == r.bibliography {
+			if entering {
+				WriteString(w, `\printbibliography[title={`+escapeString(strings.TrimSpace(nodeText(node)))+"}]\n\n")
+			}
+			return bf.SkipChildren
+		}
+		if entering && r.FloatBarriers && r.headingLevel(node) == 1 {
+			// keeps the floats within their section
+			if r.sectionOpen {
+				WriteString(w, `\FloatBarrier`+"\n")
+			}
+			r.sectionOpen = true
+		}
 		if entering {
-			if n := node.Level - 1; n < len(headers) {
+			headers := r.headers()
+			if n := r.headingLevel(node) - 1; n < len(headers) {
 				WriteByte(w, '\\')
 				WriteString(w, headers[n])
-				if len(node.HeadingData.Config) > 0 {
-					cfg := string(node.HeadingData.Config[:])
-					switch cfg {
-					case "*", "**":
-						if node.FirstChild != nil && node.FirstChild.Type == bf.Text {
-							WriteString(w, "*[")
-							w.Write(node.FirstChild.Literal)
-							if cfg == "*" {
-								WriteString(w, "]{")
-								w.Write(node.FirstChild.Literal)
-								WriteString(w, "}\n\\addcontentsline{toc}{")
-								WriteString(w, headers[n])
-								WriteByte(w, '}')
-							} else {
-								WriteByte(w, ']')
-							}
-						}
+				cfg := string(node.HeadingData.Config)
+				if cfg == "" && r.UnnumberedSections {
+					cfg = "*"
+				}
+				switch cfg {
+				case "*":
+					// the starred commands take no short title: the title
+					// is added to the table of contents apart
+					buf := getBuffer()
+					for c := node.FirstChild; c != nil; c = c.Next {
+						c.Walk(func(node *bf.Node, entering bool) bf.WalkStatus {
+							return r.RenderNode(buf, node, entering)
+						})
 					}
+					r.closeSpans(buf)
+					WriteString(w, "*{")
+					w.Write(buf.Bytes())
+					WriteString(w, "}\n\\addcontentsline{toc}{"+headers[n]+"}")
+					putBuffer(buf)
+				case "**":
+					WriteByte(w, '*')
 				}
 				WriteByte(w, '{')
 			} else {
 				WriteString(w, `\textbf{`)
 			}
 		} else {
+			r.closeSpans(w)
 			WriteByte(w, '}')
-			switch node.Level {
+			switch r.headingLevel(node) {
 			// Paragraph need no newline.
 			case 1, 2, 3:
 				WriteByte(w, '\n')
@@ -371,6 +1082,9 @@ func (r *Renderer) RenderNode(w io.Writer, node *bf.Node, entering bool) bf.Walk
 		}
 
 	case bf.HTMLBlock:
+		if r.renderDirective(w, node) {
+			break
+		}
 		if r.HtmlBlockHandler != nil {
 			return r.HtmlBlockHandler(r, w, node, entering)
 		}
@@ -378,6 +1092,24 @@ func (r *Renderer) RenderNode(w io.Writer, node *bf.Node, entering bool) bf.Walk
 		break
 
 	case bf.HTMLSpan:
+		if isBreakTag(node.Literal) && hasAncestor(node, bf.TableCell) {
+			// Only breaks the line within the paragraph columns, and
+			// separates the words in the others.
+			if r.isParagraphCell(node) {
+				WriteString(w, `\newline `)
+			} else {
+				WriteByte(w, ' ')
+			}
+			break
+		}
+		if name, arg, ok := parseDirective(node.Literal); ok && name == "tex" {
+			// Raw inline LaTeX: <!--tex \alpha -->
+			WriteString(w, arg)
+			break
+		}
+		if r.EnableColorSpans && r.renderSpan(w, node.Literal) {
+			break
+		}
 		if r.HtmlBlockHandler != nil {
 			return r.HtmlBlockHandler(r, w, node, entering)
 		}
@@ -385,36 +1117,70 @@ func (r *Renderer) RenderNode(w io.Writer, node *bf.Node, entering bool) bf.Walk
 		break
 
 	case bf.HorizontalRule:
-		WriteString(w, `\HRule{}`+"\n")
+		WriteString(w, r.horizontalRuleCommand()+"\n")
 
 	case bf.Image:
 		if entering {
 			dest := node.LinkData.Destination
+			// A linked image is the clickable content of the link.
+			linked := node.Parent != nil && node.Parent.Type == bf.Link
 			if hasPrefixCaseInsensitive(dest, []byte("http://")) || hasPrefixCaseInsensitive(dest, []byte("https://")) {
-				WriteString(w, `\url{`)
+				if linked {
+					WriteString(w, `\nolinkurl{`)
+				} else {
+					WriteString(w, `\url{`)
+				}
 				w.Write(dest)
 				WriteByte(w, '}')
 				return bf.SkipChildren
 			}
+			if linked {
+				ext := filepath.Ext(string(dest))
+				WriteString(w, `\includegraphics[max width=`+r.textWidth()+`, max height=\textheight]{`)
+				w.Write(dest[:len(dest)-len(ext)])
+				WriteByte(w, '}')
+				return bf.SkipChildren
+			}
+			// the figure of multicols spans the columns
+			figure, width := "figure", r.textWidth()
+			if node.LinkData.Title != nil && r.multicols() {
+				figure, width = "figure*", `\textwidth`
+			}
 			if node.LinkData.Title != nil {
-				WriteString(w, `\begin{figure}[!ht]`+"\n")
+				WriteString(w, `\begin{`+figure+`}[!ht]`+"\n")
 			}
 			WriteString(w, `\begin{center}`+"\n")
 			// Trim extension so that LaTeX loads the most appropriate file.
 			ext := filepath.Ext(string(dest))
 			dest = dest[:len(dest)-len(ext)]
-			WriteString(w, `\includegraphics[max width=\textwidth, max height=\textheight]{`)
+			WriteString(w, `\includegraphics[max width=`+width+`, max height=\textheight]{`)
 			w.Write(dest)
 			WriteString(w, "}\n"+`\end{center}`+"\n")
 			if node.LinkData.Title != nil {
 				WriteString(w, `\caption{`)
 				w.Write(node.LinkData.Title)
-				WriteString(w, "}\n"+`\end{figure}`+"\n")
+				WriteString(w, "}\n"+`\end{`+figure+`}`+"\n")
 			}
 		}
 		return bf.SkipChildren
 
 	case bf.Item:
+		if r.DefinitionListAsTable && node.Parent.ListFlags&bf.ListTypeDefinition != 0 {
+			switch {
+			case node.ListFlags&bf.ListTypeTerm != 0:
+				if !entering {
+					WriteString(w, " & ")
+				}
+			case entering:
+				// more definitions of the same term
+				if node.Prev != nil && node.Prev.ListFlags&bf.ListTypeTerm == 0 {
+					WriteString(w, " & ")
+				}
+			default:
+				WriteString(w, ` \\`+"\n")
+			}
+			break
+		}
 		if entering {
 			if node.ListFlags&bf.ListTypeTerm != 0 {
 				WriteString(w, `\item [`)
@@ -424,15 +1190,27 @@ func (r *Renderer) RenderNode(w io.Writer, node *bf.Node, entering bool) bf.Walk
 		} else {
 			if node.ListFlags&bf.ListTypeTerm != 0 {
 				WriteString(w, "] ")
+			} else if node.Parent.IsFootnotesList {
+				// Footnote items hold their text without a paragraph.
+				WriteByte(w, '\n')
 			}
 		}
 
 	case bf.Link:
-		// TODO: Relative links do not make sense in LaTeX. Print a warning?
 		dest := node.LinkData.Destination
 
+		// Relative links do not make sense in LaTeX.
+		if node.NoteID == 0 && isRelativeLink(dest) {
+			if entering {
+				r.warnings = append(r.warnings, fmt.Sprintf("relative link %q to %q", strings.TrimSpace(nodeText(node)), dest))
+			}
+			if r.RelativeLinksAsText {
+				break
+			}
+		}
+
 		// Raw URI
-		if needSkipLink(r.Flags, dest) {
+		if needSkipLink(r.Flags, r.trustedProtocols(), dest) {
 			if node.FirstChild != node.LastChild || node.FirstChild.Type != bf.Text || bytes.Compare(dest, node.FirstChild.Literal) != 0 {
 				if !entering {
 					WriteString(w, `\footnote{\nolinkurl{`)
@@ -451,23 +1229,46 @@ func (r *Renderer) RenderNode(w io.Writer, node *bf.Node, entering bool) bf.Walk
 
 		// Footnotes
 		if node.NoteID != 0 {
-			if entering {
-				WriteString(w, `\footnote{`)
-				w := &bytes.Buffer{}
+			if entering && r.FootnotesAsEndSection {
+				WriteString(w, `\textsuperscript{`+strconv.Itoa(node.NoteID)+`}`)
+			} else if entering {
+				if r.BracketedFootnoteMarks {
+					id := strconv.Itoa(node.NoteID)
+					WriteString(w, `\textsuperscript{[`+id+`]}\footnotetext[`+id+`]{`)
+				} else {
+					WriteString(w, `\footnote{`)
+				}
+				buf := getBuffer()
 				footnoteNode := node.LinkData.Footnote
 				footnoteNode.Walk(func(node *bf.Node, entering bool) bf.WalkStatus {
 					if node == footnoteNode {
 						return bf.GoToNext
 					}
-					return r.RenderNode(w, node, entering)
+					return r.RenderNode(buf, node, entering)
 				})
-				w.Write(w.Bytes())
+				w.Write(buf.Bytes())
+				putBuffer(buf)
 				WriteString(w, `}`)
 			}
 			break
 		}
 
 		// Normal link
+		if entering && r.EmailCommand != "" && isEmailAutolink(node) {
+			WriteString(w, `\href{`)
+			w.Write(dest)
+			WriteString(w, `}{\`+r.EmailCommand+`{`+escapeString(string(node.FirstChild.Literal))+`}}`)
+			return bf.SkipChildren
+		}
+		if entering && r.ShortenAutolinks && node.FirstChild != nil && node.FirstChild == node.LastChild &&
+			node.FirstChild.Type == bf.Text && bytes.Equal(dest, node.FirstChild.Literal) {
+			if u, err := url.Parse(string(dest)); err == nil && u.Host != "" {
+				WriteString(w, `\href{`)
+				w.Write(dest)
+				WriteString(w, `}{`+escapeString(u.Host)+`\ldots{}}`)
+				return bf.SkipChildren
+			}
+		}
 		if entering {
 			WriteString(w, `\href{`)
 			w.Write(dest)
@@ -478,29 +1279,48 @@ func (r *Renderer) RenderNode(w io.Writer, node *bf.Node, entering bool) bf.Walk
 
 	case bf.List:
 		if node.IsFootnotesList {
-			// The footnote list is not needed for LaTeX as the footnotes are rendered
-			// directly from the links.
-			return bf.SkipChildren
+			if !r.FootnotesAsEndSection {
+				// The footnote list is not needed for LaTeX as the footnotes are
+				// rendered directly from the links.
+				return bf.SkipChildren
+			}
+			if entering {
+				WriteString(w, `\section*{Notes}`+"\n\n")
+			}
 		}
 		listType := "itemize"
 		if node.ListFlags&bf.ListTypeOrdered != 0 {
 			listType = "enumerate"
 		}
 		if node.ListFlags&bf.ListTypeDefinition != 0 {
+			if r.DefinitionListAsTable {
+				if entering {
+					WriteString(w, `\begin{tabular}{lp{0.6`+r.textWidth()+`}}`+"\n")
+				} else {
+					WriteString(w, `\end{tabular}`+"\n\n")
+				}
+				break
+			}
 			listType = "description"
 		}
 		r.Env(w, listType, entering)
+		if entering && isOrderedList(node) {
+			r.renderListStart(w, node)
+		}
 
 	case bf.Paragraph:
-		if !entering {
-			// If paragraph is the term of a definition list, don't insert new lines.
-			if node.Parent.Type != bf.Item || node.Parent.ListFlags&bf.ListTypeTerm == 0 {
-				WriteByte(w, '\n')
-				// Don't insert an additional linebreak after last node of an item, a quote, etc.
-				if node.Next != nil {
-					WriteByte(w, '\n')
-				}
+		if entering {
+			if expr, ok := displayMath(node); ok {
+				// The children are skipped, and the paragraph exit with them.
+				WriteString(w, "\\[\n")
+				w.Write(expr)
+				WriteString(w, "\n\\]")
+				r.paragraphEnd(w, node)
+				return bf.SkipChildren
 			}
+		} else {
+			r.closeSpans(w)
+			r.paragraphEnd(w, node)
 		}
 
 	case bf.Softbreak:
@@ -512,21 +1332,36 @@ func (r *Renderer) RenderNode(w io.Writer, node *bf.Node, entering bool) bf.Walk
 		r.Cmd(w, "textbf", entering)
 
 	case bf.Table:
-		border := node.TableData.Border
-
 		if entering {
-			WriteString(w, `\begin{center}`+"\n"+`\begin{tabular}{`)
-			node.Walk(func(c *bf.Node, entering bool) bf.WalkStatus {
+			r.tableBorder = tableBorderOf(node)
+			if preset, ok := tableBorderPresets[r.TableBorderPreset]; ok && r.tableBorder == (tableBorder{}) {
+				r.tableBorder = preset
+			}
+		}
+		border := r.tableBorder
+
+		if entering {
+			WriteString(w, `\begin{center}`+"\n")
+			if r.TableZebra {
+				colors := r.tableZebraColors()
+				WriteString(w, `\rowcolors{2}{`+colors[0]+`}{`+colors[1]+"}\n")
+			}
+			if r.TableAutoWidth {
+				WriteString(w, `\begin{tabularx}{`+r.textWidth()+`}{`)
+			} else {
+				WriteString(w, `\begin{tabular}{`)
+			}
+			node.Walk(func(c *bf.Node, entering bool) bf.WalkStatus {
 				if c.Type == bf.TableCell && entering {
 					i := 0
 
 					var writed, sep bool
-					if border.Left {
+					if border.left {
 						WriteByte(w, '|')
 					}
 					for cell := c; cell != nil; cell = cell.Next {
 						writed = false
-						sep = border.Column
+						sep = border.column
 
 						if cell.TableCellData.Opts == nil {
 							if cell.TableCellData.IsLast {
@@ -545,7 +1380,7 @@ func (r *Renderer) RenderNode(w io.Writer, node *bf.Node, entering bool) bf.Walk
 								sep, _ = v.(bool)
 							}
 							if !width.IsZero() {
-								WriteString(w, fmt.Sprintf(`p{%s\textwidth}`, width))
+								WriteString(w, fmt.Sprintf(`%c{%s%s}`, cellVAlign(cell), width, r.textWidth()))
 								switch cell.Align {
 								case bf.TableAlignmentRight:
 									WriteString(w, `<{\raggedleft\arraybackslash}`)
@@ -556,7 +1391,16 @@ func (r *Renderer) RenderNode(w io.Writer, node *bf.Node, entering bool) bf.Walk
 								writed = true
 							}
 						}
-						if !writed {
+						if !writed && r.TableAutoWidth {
+							// equal flexible width
+							switch cell.Align {
+							case bf.TableAlignmentRight:
+								WriteString(w, `>{\raggedleft\arraybackslash}`)
+							case bf.TableAlignmentCenter:
+								WriteString(w, `>{\centering\arraybackslash}`)
+							}
+							WriteByte(w, 'X')
+						} else if !writed {
 							WriteByte(w, cellAlignment[cell.Align])
 						}
 						if sep {
@@ -565,7 +1409,7 @@ func (r *Renderer) RenderNode(w io.Writer, node *bf.Node, entering bool) bf.Walk
 						i++
 					}
 
-					if !sep && border.Rigth {
+					if !sep && border.right {
 						WriteByte(w, '|')
 					}
 					return bf.Terminate
@@ -573,14 +1417,19 @@ func (r *Renderer) RenderNode(w io.Writer, node *bf.Node, entering bool) bf.Walk
 				return bf.GoToNext
 			})
 			WriteString(w, "}\n")
-			if border.Top {
+			if border.top {
 				WriteString(w, "\\hline\n")
 			}
 		} else {
-			if border.Bottom {
+			if border.bottom {
 				WriteString(w, "\\hline\n")
 			}
-			WriteString(w, `\end{tabular}`+"\n"+`\end{center}`+"\n\n")
+			if r.TableAutoWidth {
+				WriteString(w, `\end{tabularx}`+"\n")
+			} else {
+				WriteString(w, `\end{tabular}`+"\n")
+			}
+			WriteString(w, `\end{center}`+"\n\n")
 		}
 
 	case bf.TableBody:
@@ -588,12 +1437,30 @@ func (r *Renderer) RenderNode(w io.Writer, node *bf.Node, entering bool) bf.Walk
 		break
 
 	case bf.TableCell:
+		if !entering {
+			break
+		}
+		// render the content first, so that the trailing whitespace does
+		// not double the space before the separator.
+		buf := getBuffer()
+		for c := node.FirstChild; c != nil; c = c.Next {
+			c.Walk(func(node *bf.Node, entering bool) bf.WalkStatus {
+				return r.RenderNode(buf, node, entering)
+			})
+		}
+		r.closeSpans(buf)
 		if node.IsHeader {
-			r.Cmd(w, "textbf", entering)
+			r.Cmd(w, "textbf", true)
 		}
-		if !entering && node.Next != nil {
+		w.Write(bytes.TrimRight(buf.Bytes(), " \t"))
+		putBuffer(buf)
+		if node.IsHeader {
+			r.Cmd(w, "textbf", false)
+		}
+		if node.Next != nil {
 			WriteString(w, " & ")
 		}
+		return bf.SkipChildren
 
 	case bf.TableHead:
 		if !entering {
@@ -602,9 +1469,9 @@ func (r *Renderer) RenderNode(w io.Writer, node *bf.Node, entering bool) bf.Walk
 
 	case bf.TableRow:
 		if !entering {
-			if node.Parent.Parent.TableData.Border.Row {
+			if r.tableBorder.row {
 				if node.Parent.Type == bf.TableBody {
-					if node.TableRowData.IsLast {
+					if node.Next == nil {
 						WriteString(w, ` \\`+"\n")
 					} else {
 						WriteString(w, ` \\ \hline`+"\n")
@@ -619,7 +1486,11 @@ func (r *Renderer) RenderNode(w io.Writer, node *bf.Node, entering bool) bf.Walk
 
 	case bf.Text:
 		if len(node.Literal) > 0 {
-			r.Escape(w, node.Literal)
+			if r.Highlight {
+				r.highlight(w, node.Literal)
+			} else {
+				r.inlineText(w, node.Literal)
+			}
 		}
 		break
 
@@ -629,6 +1500,142 @@ func (r *Renderer) RenderNode(w io.Writer, node *bf.Node, entering bool) bf.Walk
 	return bf.GoToNext
 }
 
+func (r *Renderer) text(w io.Writer, text []byte) {
+	if r.EmojiMode != EmojiNone {
+		r.EscapeEmojis(w, text)
+	} else {
+		r.Escape(w, text)
+	}
+}
+
+// inlineText writes the text, with its `$...$` spans as inline math if
+// DollarMath is set.
+func (r *Renderer) inlineText(w io.Writer, text []byte) {
+	if r.DollarMath {
+		r.dollarMath(w, text)
+	} else {
+		r.text(w, text)
+	}
+}
+
+// highlight writes the text with its `==...==` spans as the `\hl` of soul.
+func (r *Renderer) highlight(w io.Writer, text []byte) {
+	start := 0
+	for i := 0; i+1 < len(text); i++ {
+		if text[i] != '=' || text[i+1] != '=' {
+			continue
+		}
+		if end := closingHighlight(text, i+2); end > 0 {
+			r.inlineText(w, text[start:i])
+			WriteString(w, `\hl{`)
+			r.inlineText(w, text[i+2:end])
+			WriteString(w, `}`)
+			i = end + 1
+			start = i + 1
+		}
+	}
+	r.inlineText(w, text[start:])
+}
+
+// closingHighlight returns the index of the `==` closing the highlight
+// opened before from, or -1. The highlight can't start or end with a space.
+func closingHighlight(text []byte, from int) int {
+	if from >= len(text) || isSpace(text[from]) || text[from] == '=' {
+		return -1
+	}
+	for j := from + 1; j+1 < len(text); j++ {
+		if text[j] == '=' && text[j+1] == '=' && !isSpace(text[j-1]) {
+			return j
+		}
+	}
+	return -1
+}
+
+// dollarMath writes the text with its `$...$` spans as inline math.
+func (r *Renderer) dollarMath(w io.Writer, text []byte) {
+	start := 0
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			if i+1 < len(text) && text[i+1] == '$' {
+				r.text(w, text[start:i])
+				WriteString(w, `\$`)
+				i++
+				start = i + 1
+			}
+		case '$':
+			if end := closingDollar(text, i+1); end > 0 {
+				r.text(w, text[start:i])
+				w.Write(text[i : end+1])
+				i = end
+				start = i + 1
+			}
+		}
+	}
+	r.text(w, text[start:])
+}
+
+// closingDollar returns the index of the `$` closing the inline math opened
+// before from, or -1. As in pandoc, the math can't start or end with a
+// space, and the closing `$` can't be followed by a digit, so that prices
+// like `$5 and $10` are not math.
+func closingDollar(text []byte, from int) int {
+	if from >= len(text) || isSpace(text[from]) || text[from] == '$' {
+		return -1
+	}
+	for j := from; j < len(text); j++ {
+		switch text[j] {
+		case '\\':
+			j++
+		case '$':
+			if !isSpace(text[j-1]) && (j+1 == len(text) || text[j+1] < '0' || text[j+1] > '9') {
+				return j
+			}
+		}
+	}
+	return -1
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func (r *Renderer) paragraphEnd(w io.Writer, node *bf.Node) {
+	// If paragraph is the term of a definition list, don't insert new lines.
+	if r.DefinitionListAsTable && node.Parent.Type == bf.Item && node.Parent.Parent.ListFlags&bf.ListTypeDefinition != 0 {
+		// Table cells can't hold paragraph breaks.
+		if node.Next != nil {
+			WriteString(w, `\newline `)
+		}
+	} else if node.Parent.Type != bf.Item || node.Parent.ListFlags&bf.ListTypeTerm == 0 {
+		WriteByte(w, '\n')
+		// Don't insert an additional linebreak after last node of an item, a quote, etc.
+		if node.Next != nil {
+			WriteByte(w, '\n')
+		}
+	}
+}
+
+// displayMath returns the expression of the paragraph that is exactly
+// `$$ expr $$`, the display math.
+func displayMath(node *bf.Node) (expr []byte, ok bool) {
+	var text []byte
+	for c := node.FirstChild; c != nil; c = c.Next {
+		if c.Type != bf.Text {
+			return nil, false
+		}
+		text = append(text, c.Literal...)
+	}
+	text = bytes.TrimSpace(text)
+	if len(text) < 4 || !bytes.HasPrefix(text, []byte("$$")) || !bytes.HasSuffix(text, []byte("$$")) {
+		return nil, false
+	}
+	if expr = bytes.TrimSpace(text[2 : len(text)-2]); len(expr) == 0 || bytes.Contains(expr, []byte("$$")) {
+		return nil, false
+	}
+	return expr, true
+}
+
 // Get title: concatenate all Text children of Titleblock.
 func getTitle(ast *bf.Node) []byte {
 	titleRenderer := Renderer{}
@@ -646,50 +1653,36 @@ func getTitle(ast *bf.Node) []byte {
 	return buf.Bytes()
 }
 
-func hasFigures(ast *bf.Node) bool {
+// hasDirective reports whether ast has any of the block directives names.
+func hasDirective(ast *bf.Node, names ...string) bool {
 	result := false
 	ast.Walk(func(node *bf.Node, entering bool) bf.WalkStatus {
-		if node.Type == bf.Image && node.LinkData.Title != nil {
-			result = true
-			return bf.Terminate
+		if node.Type == bf.HTMLBlock {
+			if n, _, ok := parseDirective(node.Literal); ok {
+				for _, name := range names {
+					if n == name {
+						result = true
+						return bf.Terminate
+					}
+				}
+			}
 		}
 		return bf.GoToNext
 	})
 	return result
 }
 
-// RenderHeader prints the LaTeX preamble if CompletePage is on.
-func (r *Renderer) RenderHeader(w io.Writer, ast *bf.Node) {
-	var title string
-
-	if r.Flags&CompletePage != 0 {
-		title = string(getTitle(ast))
-
-		// TODO: Color source code and links?
-		io.WriteString(w, `\documentclass{article}
-
-\usepackage[utf8]{inputenc}
-\usepackage[T1]{fontenc}
-\usepackage{lmodern}
-\usepackage{marvosym}
-\usepackage{textcomp}
-\DeclareUnicodeCharacter{20AC}{\EUR{}}
-\DeclareUnicodeCharacter{2260}{\neq}
-\DeclareUnicodeCharacter{2264}{\leq}
-\DeclareUnicodeCharacter{2265}{\geq}
-\DeclareUnicodeCharacter{22C5}{\cdot}
-\DeclareUnicodeCharacter{A0}{~}
-\DeclareUnicodeCharacter{B1}{\pm}
-\DeclareUnicodeCharacter{D7}{\times}
-
-\usepackage{amsmath}
-\usepackage[export]{adjustbox} % loads also graphicx
-\usepackage{listings}
-\usepackage[margin=1in]{geometry}
-\usepackage{verbatim}
-\usepackage[normalem]{ulem}
-\usepackage{hyperref}
+func (r *Renderer) renderTOC(w io.Writer) {
+	if r.TOCDepth > 0 {
+		WriteString(w, `\setcounter{tocdepth}{`+strconv.Itoa(r.TOCDepth)+"}\n")
+	}
+	WriteString(w, `\tableofcontents
+`)
+}
 
+// renderListingsSetup writes the listings setup of the preamble.
+func (r *Renderer) renderListingsSetup(w io.Writer, features featureSet) {
+	io.WriteString(w, `
 \lstset{
 	numbers=left,
 	breaklines=true,
@@ -704,11 +1697,11 @@ func (r *Renderer) RenderHeader(w io.Writer, ast *bf.Node) {
 	{á}{{\'a}}1 {é}{{\'e}}1 {í}{{\'i}}1 {ó}{{\'o}}1 {ú}{{\'u}}1
 	{Á}{{\'A}}1 {É}{{\'E}}1 {Í}{{\'I}}1 {Ó}{{\'O}}1 {Ú}{{\'U}}1
 	`)
-		io.WriteString(w,
-			"{à}{{\\`a}}1 {è}{{\\`e}}1 {ì}{{\\`i}}1 {ò}{{\\`o}}1 {ù}{{\\`u}}1"+
-				"\n\t"+
-				"{À}{{\\`A}}1 {È}{{\\'E}}1 {Ì}{{\\`I}}1 {Ò}{{\\`O}}1 {Ù}{{\\`U}}1")
-		io.WriteString(w, `
+	io.WriteString(w,
+		"{à}{{\\`a}}1 {è}{{\\`e}}1 {ì}{{\\`i}}1 {ò}{{\\`o}}1 {ù}{{\\`u}}1"+
+			"\n\t"+
+			"{À}{{\\`A}}1 {È}{{\\'E}}1 {Ì}{{\\`I}}1 {Ò}{{\\`O}}1 {Ù}{{\\`U}}1")
+	io.WriteString(w, `
 	{ä}{{\"a}}1 {ë}{{\"e}}1 {ï}{{\"i}}1 {ö}{{\"o}}1 {ü}{{\"u}}1
 	{Ä}{{\"A}}1 {Ë}{{\"E}}1 {Ï}{{\"I}}1 {Ö}{{\"O}}1 {Ü}{{\"U}}1
 	{â}{{\^a}}1 {ê}{{\^e}}1 {î}{{\^i}}1 {ô}{{\^o}}1 {û}{{\^u}}1
@@ -720,97 +1713,727 @@ func (r *Renderer) RenderHeader(w io.Writer, ast *bf.Node) {
 }
 `)
 
-		if r.Languages != "" {
-			io.WriteString(w, "\n"+`\usepackage[`+r.Languages+`]{babel}`+"\n")
+	if features.highlights {
+		// the `hl` lines of the code blocks, for the linebackgroundcolor
+		// listings option. Renew it to change the color.
+		io.WriteString(w, `\usepackage{lstlinebgrd}
+\newcommand{\lsthl}[2]{\ifnum\value{lstnumber}<#1\else\ifnum\value{lstnumber}>#2\else\color{yellow!30}\fi\fi}
+`)
+	}
+
+	if r.ListingName != "" {
+		io.WriteString(w, `\renewcommand{\lstlistingname}{`+escapeString(r.ListingName)+"}\n")
+	}
+
+	if r.ListingUnnumbered {
+		io.WriteString(w, `\usepackage{caption}
+\DeclareCaptionLabelFormat{unnumbered}{#1}
+\captionsetup[lstlisting]{labelformat=unnumbered}
+`)
+	}
+}
+
+func hasFigures(ast *bf.Node) bool {
+	result := false
+	ast.Walk(func(node *bf.Node, entering bool) bf.WalkStatus {
+		if node.Type == bf.Image && node.LinkData.Title != nil {
+			result = true
+			return bf.Terminate
+		}
+		return bf.GoToNext
+	})
+	return result
+}
+
+// Get the concatenated literals of the Text and Code nodes within node.
+func nodeText(node *bf.Node) string {
+	var buf bytes.Buffer
+	node.Walk(func(c *bf.Node, entering bool) bf.WalkStatus {
+		if c.Type == bf.Text || c.Type == bf.Code {
+			buf.Write(c.Literal)
 		}
+		return bf.GoToNext
+	})
+	return buf.String()
+}
 
-		io.WriteString(w, `\usepackage{csquotes}
+// findAbstract looks for the top-level heading named AbstractHeading. When
+// found, the heading is skipped and its content, up to the next heading, is
+// rendered as the abstract.
+func (r *Renderer) findAbstract(ast *bf.Node) {
+	r.abstract = nil
+	if r.AbstractHeading == "" || strings.TrimSpace(r.Abstract) != "" {
+		return
+	}
+	for node := ast.FirstChild; node != nil; node = node.Next {
+		if node.Type != bf.Heading || node.Level != 1 || node.IsTitleblock ||
+			!strings.EqualFold(strings.TrimSpace(nodeText(node)), r.AbstractHeading) {
+			continue
+		}
+		var buf bytes.Buffer
+		r.skip[node] = true
+		for c := node.Next; c != nil && c.Type != bf.Heading; c = c.Next {
+			r.skip[c] = true
+			c.Walk(func(node *bf.Node, entering bool) bf.WalkStatus {
+				return r.RenderNode(&buf, node, entering)
+			})
+		}
+		r.abstract = bytes.TrimSpace(buf.Bytes())
+		return
+	}
+}
+
+// DefaultBibliographyHeading is the default Opts.BibliographyHeading.
+const DefaultBibliographyHeading = "References"
 
-\hypersetup{colorlinks,
-	citecolor=black,
-	filecolor=black,
-	linkcolor=black,
-	linktoc=page,
-	urlcolor=black,
-	pdfstartview=FitH,
-	breaklinks=true,
-	pdfauthor={Blackfriday Markdown Processor v`)
-		io.WriteString(w, bf.Version)
-		io.WriteString(w, `},
+func (r *Renderer) bibliographyHeading() string {
+	if r.BibliographyHeading == "" {
+		return DefaultBibliographyHeading
+	}
+	return r.BibliographyHeading
 }
 
-\newcommand{\HRule}{\rule{\linewidth}{0.5mm}}
-\addtolength{\parskip}{0.5\baselineskip}
+// findBibliography looks for the heading named BibliographyHeading if there
+// is a BibResource. When found, the lists of its section, the hand-written
+// references, are skipped with a warning, as the heading renders the
+// bibliography.
+func (r *Renderer) findBibliography(ast *bf.Node) {
+	r.bibliography = nil
+	if r.BibResource == "" {
+		return
+	}
+	heading := r.bibliographyHeading()
+	ast.Walk(func(node *bf.Node, entering bool) bf.WalkStatus {
+		if node.Type == bf.Heading && !node.IsTitleblock &&
+			strings.EqualFold(strings.TrimSpace(nodeText(node)), heading) {
+			r.bibliography = node
+			for c := node.Next; c != nil && (c.Type != bf.Heading || c.Level > node.Level); c = c.Next {
+				if c.Type == bf.List {
+					r.skip[c] = true
+					r.warnings = append(r.warnings, fmt.Sprintf("the list of the %q section is replaced by the bibliography", heading))
+				}
+			}
+			return bf.Terminate
+		}
+		return bf.GoToNext
+	})
+}
+
+func (r *Renderer) renderAbstract(w io.Writer) {
+	if abstract := strings.TrimSpace(r.Abstract); abstract != "" {
+		io.WriteString(w, "\n"+`\begin{abstract}`+"\n"+escapeString(abstract)+"\n"+`\end{abstract}`+"\n")
+	} else if len(r.abstract) > 0 {
+		io.WriteString(w, "\n"+`\begin{abstract}`+"\n")
+		w.Write(r.abstract)
+		io.WriteString(w, "\n"+`\end{abstract}`+"\n")
+	}
+	r.renderKeywords(w)
+}
+
+func (r *Renderer) renderKeywords(w io.Writer) {
+	if len(r.Keywords) == 0 {
+		return
+	}
+	keywords := make([]string, len(r.Keywords))
+	for i, k := range r.Keywords {
+		keywords[i] = escapeString(strings.TrimSpace(k))
+	}
+	io.WriteString(w, "\n"+`\keywords{`+strings.Join(keywords, ", ")+"}\n")
+}
+
+// authors returns the `\author` value of Authors, or of Author if Authors
+// is empty.
+func (r *Renderer) authors() string {
+	authors := r.Authors
+	if len(authors) == 0 && r.Author != "" {
+		authors = []Author{{Name: r.Author}}
+	}
+	var parts []string
+	for _, a := range authors {
+		s := escapeString(a.Name)
+		if a.Affiliation != "" {
+			s += `\thanks{` + escapeString(a.Affiliation) + `}`
+		}
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, ` \and `)
+}
+
+// hyperrefDefaults are the default hyperref options, see
+// Opts.HyperrefOptions. The empty values are bare keys.
+var hyperrefDefaults = []struct{ key, value string }{
+	{"colorlinks", ""},
+	{"citecolor", "black"},
+	{"filecolor", "black"},
+	{"linkcolor", "black"},
+	{"linktoc", "page"},
+	{"urlcolor", "black"},
+	{"pdfstartview", "FitH"},
+	{"breaklinks", "true"},
+}
+
+// renderHypersetup writes the `\hypersetup` of the hyperrefDefaults merged
+// with the HyperrefOptions, and the PDF metadata of the document title.
+func (r *Renderer) renderHypersetup(w io.Writer, title string) {
+	var opts []string
+	add := func(key, value string) {
+		if value == "" {
+			opts = append(opts, key)
+		} else {
+			opts = append(opts, key+"="+value)
+		}
+	}
+	for _, d := range hyperrefDefaults {
+		if value, ok := r.HyperrefOptions[d.key]; ok {
+			add(d.key, value)
+		} else {
+			add(d.key, d.value)
+		}
+	}
+	var keys []string
+	for key := range r.HyperrefOptions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		known := false
+		for _, d := range hyperrefDefaults {
+			known = known || d.key == key
+		}
+		if !known {
+			add(key, r.HyperrefOptions[key])
+		}
+	}
+	if author := r.pdfAuthor(); author != "" {
+		add("pdfauthor", "{"+author+"}")
+	}
+	if title != "" {
+		add("pdftitle", "{"+strings.Join(strings.Fields(title), " ")+"}")
+	}
+	add("pdfcreator", "{Blackfriday Markdown Processor v"+bf.Version+"}")
+	io.WriteString(w, `\hypersetup{`+strings.Join(opts, ",\n\t")+",\n}\n")
+}
+
+// pdfAuthor returns the escaped author names, without affiliations.
+func (r *Renderer) pdfAuthor() string {
+	names := make([]string, 0, len(r.Authors))
+	for _, a := range r.Authors {
+		names = append(names, escapeString(a.Name))
+	}
+	if len(names) == 0 && r.Author != "" {
+		names = append(names, escapeString(r.Author))
+	}
+	return strings.Join(names, ", ")
+}
+
+// renderPreamble writes the generated preamble, between `\documentclass`
+// and `\begin{document}`.
+func (r *Renderer) renderPreamble(w io.Writer, ast *bf.Node, title string) {
+	// TODO: Color source code and links?
+	features := r.scanFeatures(ast)
+
+	if r.Engine.Unicode() {
+		// fontspec reads the unicode input with the system fonts
+		io.WriteString(w, `\usepackage{fontspec}
+`)
+		if r.MainFont != "" {
+			io.WriteString(w, `\setmainfont{`+r.MainFont+`}
 `)
+		}
+		io.WriteString(w, `\usepackage{marvosym}
+\usepackage{textcomp}
 
-		if r.Flags&NoParIndent != 0 {
-			io.WriteString(w, `\parindent=0pt
+`)
+	} else {
+		io.WriteString(w, `\usepackage[utf8]{inputenc}
+\usepackage[T1]{fontenc}
+\usepackage{lmodern}
+\usepackage{marvosym}
+\usepackage{textcomp}
+\DeclareUnicodeCharacter{20AC}{\EUR{}}
+\DeclareUnicodeCharacter{2260}{\neq}
+\DeclareUnicodeCharacter{2264}{\leq}
+\DeclareUnicodeCharacter{2265}{\geq}
+\DeclareUnicodeCharacter{22C5}{\cdot}
+\DeclareUnicodeCharacter{A0}{~}
+\DeclareUnicodeCharacter{B1}{\pm}
+\DeclareUnicodeCharacter{D7}{\times}
+
+`)
+	}
+	// the packages of the document content only, unless it has raw LaTeX
+	if r.TableZebra && (features.tables || features.raw) {
+		// before any package loading xcolor without the option
+		io.WriteString(w, `\usepackage[table]{xcolor}
+`)
+	}
+	if features.math || features.raw || r.NumberWithinSection {
+		io.WriteString(w, `\usepackage{amsmath}
+`)
+	}
+	if features.images || features.raw {
+		io.WriteString(w, `\usepackage[export]{adjustbox} % loads also graphicx
+`)
+	}
+	if features.code || features.colors || features.raw {
+		io.WriteString(w, `\usepackage{xcolor}
+`)
+	}
+	if features.code || features.raw {
+		io.WriteString(w, `\usepackage{listings}
+`)
+	}
+	if geometry := r.geometryOptions(); geometry != GeometryNone {
+		io.WriteString(w, `\usepackage[`+geometry+`]{geometry}
+`)
+	}
+	io.WriteString(w, `\usepackage{verbatim}
+`)
+	if features.array {
+		io.WriteString(w, `\usepackage{array}
+`)
+	}
+	if r.TableAutoWidth && (features.tables || features.raw) {
+		io.WriteString(w, `\usepackage{tabularx}
+`)
+	}
+	if features.listDepth > maxListDepth {
+		r.renderListDepth(w, features.listDepth)
+	}
+	if features.strikethrough || features.raw {
+		io.WriteString(w, `\usepackage[normalem]{ulem}
+`)
+	}
+	if r.Columns > 1 {
+		io.WriteString(w, `\usepackage{multicol}
+`)
+	}
+	if r.FloatBarriers {
+		io.WriteString(w, `\usepackage{placeins}
+`)
+	}
+	if r.BibResource != "" {
+		io.WriteString(w, `\usepackage{biblatex}
+\addbibresource{`+r.BibResource+`}
+`)
+	}
+	if features.marks {
+		io.WriteString(w, `\usepackage{soul}
+`)
+		if r.HighlightColor != "" {
+			io.WriteString(w, `\sethlcolor{`+r.HighlightColor+`}
 `)
 		}
+	}
+	io.WriteString(w, `\usepackage{hyperref}
+`)
 
-		if title != "" {
-			io.WriteString(w, `
+	if features.code || features.raw {
+		r.renderListingsSetup(w, features)
+	}
+
+	if r.BreakURLs {
+		io.WriteString(w, `\usepackage{xurl}`+"\n")
+	}
+
+	if r.Languages != "" {
+		io.WriteString(w, "\n"+`\usepackage[`+r.Languages+`]{babel}`+"\n")
+	}
+
+	for _, pkg := range features.passthrough {
+		io.WriteString(w, `\usepackage{`+pkg+"}\n")
+	}
+
+	if r.emojiMode() == EmojiCommand {
+		io.WriteString(w, `\usepackage{emoji}`+"\n")
+	}
+
+	if r.EnvQuotationAttributed == "epigraph" {
+		io.WriteString(w, `\usepackage{epigraph}`+"\n")
+	}
+
+	io.WriteString(w, `\usepackage{csquotes}
+
+`)
+	r.renderHypersetup(w, title)
+	if r.horizontalRuleCommand() == DefaultHorizontalRuleCommand {
+		io.WriteString(w, `
+\newcommand{\HRule}{\rule{\linewidth}{0.5mm}}
+`)
+	}
+	switch r.ParSkip {
+	case "":
+		io.WriteString(w, `\addtolength{\parskip}{0.5\baselineskip}
+`)
+	case ParSkipPackage:
+		io.WriteString(w, `\usepackage{parskip}
+`)
+	default:
+		io.WriteString(w, `\setlength{\parskip}{`+r.ParSkip+`}
+`)
+	}
+
+	if r.EmailCommand != "" && r.EmailCommand != "texttt" {
+		io.WriteString(w, `\providecommand{\`+r.EmailCommand+`}[1]{\texttt{#1}}
+`)
+	}
+
+	if len(r.Keywords) > 0 {
+		io.WriteString(w, `\providecommand{\keywords}[1]{\par\noindent\textbf{Keywords:} #1}
+`)
+	}
+
+	if r.Flags&NoParIndent != 0 || r.ParIndent == "0pt" {
+		io.WriteString(w, `\parindent=0pt
+`)
+	} else if r.ParIndent != "" {
+		io.WriteString(w, `\setlength{\parindent}{`+r.ParIndent+`}
+`)
+	}
+
+	if r.SecNumDepth > 0 {
+		io.WriteString(w, `\setcounter{secnumdepth}{`+strconv.Itoa(r.SecNumDepth)+"}\n")
+	}
+
+	if r.NumberWithinSection {
+		io.WriteString(w, `\numberwithin{figure}{section}
+\numberwithin{table}{section}
+`)
+	}
+
+	if title != "" {
+		io.WriteString(w, `
 \title{`+title+`}
-\author{`+r.Author+`}
+\author{`+r.authors()+`}
 `)
+		switch r.Date {
+		case "":
+			// LaTeX defaults to \today
+		case DateNone:
+			io.WriteString(w, `\date{}`+"\n")
+		case DateToday:
+			if r.DateFormat == "" {
+				io.WriteString(w, `\date{\today}`+"\n")
+				break
+			}
+			now := r.Now
+			if now.IsZero() {
+				now = time.Now()
+			}
+			io.WriteString(w, `\date{`+escapeString(now.Format(r.DateFormat))+"}\n")
+		default:
+			io.WriteString(w, `\date{`+escapeString(r.Date)+"}\n")
+		}
+	}
+}
+
+// DefaultHardbreakCommand is the default Opts.HardbreakCommand.
+const DefaultHardbreakCommand = `~\\`
+
+func (r *Renderer) hardbreakCommand() string {
+	if r.HardbreakCommand == "" {
+		return DefaultHardbreakCommand
+	}
+	return r.HardbreakCommand
+}
+
+// DefaultHorizontalRuleCommand is the default Opts.HorizontalRuleCommand.
+const DefaultHorizontalRuleCommand = `\HRule{}`
+
+func (r *Renderer) horizontalRuleCommand() string {
+	if r.HRuleAsNewPage {
+		return `\newpage`
+	}
+	if r.HorizontalRuleCommand == "" {
+		return DefaultHorizontalRuleCommand
+	}
+	return r.HorizontalRuleCommand
+}
+
+// multicols reports whether the body is typeset in the multicols of Columns.
+func (r *Renderer) multicols() bool {
+	return r.Flags&CompletePage != 0 && r.Columns > 1
+}
+
+// textWidth returns the width of the body lines: the `\linewidth` of the
+// column in multicols, or else `\textwidth`.
+func (r *Renderer) textWidth() string {
+	if r.multicols() {
+		return `\linewidth`
+	}
+	return `\textwidth`
+}
+
+// DefaultTableZebraColors are the default Opts.TableZebraColors.
+var DefaultTableZebraColors = [2]string{"gray!10", "white"}
+
+func (r *Renderer) tableZebraColors() (colors [2]string) {
+	for i, color := range r.TableZebraColors {
+		if colors[i] = color; color == "" {
+			colors[i] = DefaultTableZebraColors[i]
+		}
+	}
+	return
+}
+
+// tableBorder are the borders of a table: its sides, and the lines between
+// its columns and between its rows.
+type tableBorder struct {
+	left, right, top, bottom, column, row bool
+}
+
+// tableBorderOf returns the borders set by the table itself.
+func tableBorderOf(table *bf.Node) tableBorder {
+	b := table.TableData.Border
+	return tableBorder{b.Left, b.Rigth, b.Top, b.Bottom, b.Column, b.Row}
+}
+
+// tableBorderPresets are the borders of the TableBorderPreset names.
+var tableBorderPresets = map[string]tableBorder{
+	"all":        {true, true, true, true, true, true},
+	"none":       {},
+	"outer":      {left: true, right: true, top: true, bottom: true},
+	"horizontal": {top: true, bottom: true, row: true},
+}
+
+// isParagraphCell reports whether the node is in a table cell of a paragraph
+// column, which breaks its lines: a column of a width, as `p{}`, or an `X`
+// column of TableAutoWidth.
+func (r *Renderer) isParagraphCell(node *bf.Node) bool {
+	if r.TableAutoWidth {
+		return true
+	}
+	cell := node.Parent
+	for cell.Type != bf.TableCell {
+		cell = cell.Parent
+	}
+	i := 0
+	for c := cell.Prev; c != nil; c = c.Prev {
+		i++
+	}
+	// the columns are those of the first row
+	table := cell.Parent
+	for table.Type != bf.Table {
+		table = table.Parent
+	}
+	var head *bf.Node
+	table.Walk(func(c *bf.Node, entering bool) bf.WalkStatus {
+		if c.Type == bf.TableCell {
+			head = c
+			return bf.Terminate
+		}
+		return bf.GoToNext
+	})
+	for ; head != nil && i > 0; i-- {
+		head = head.Next
+	}
+	if head == nil {
+		return false
+	}
+	width, _ := head.TableCellData.Opts["width"].(decimal.Decimal)
+	return !width.IsZero()
+}
+
+// cellVAlign returns the column type of the `valign` option (`top`, `middle`
+// or `bottom`) of the table cell: `p`, `m` or `b`. The last two need the
+// array package.
+func cellVAlign(cell *bf.Node) byte {
+	switch cell.TableCellData.Opts["valign"] {
+	case "middle":
+		return 'm'
+	case "bottom":
+		return 'b'
+	}
+	return 'p'
+}
+
+// maxListDepth is the deepest list nesting of LaTeX.
+const maxListDepth = 4
+
+// renderListDepth raises the list nesting limit to depth with enumitem, and
+// labels the levels beyond maxListDepth.
+func (r *Renderer) renderListDepth(w io.Writer, depth int) {
+	d := strconv.Itoa(depth)
+	io.WriteString(w, `\usepackage{enumitem}
+\setlistdepth{`+d+`}
+\renewlist{itemize}{itemize}{`+d+`}
+\renewlist{enumerate}{enumerate}{`+d+`}
+`)
+	for level := maxListDepth + 1; level <= depth; level++ {
+		l := strconv.Itoa(level)
+		io.WriteString(w, `\setlist[itemize,`+l+`]{label=\textbullet}
+\setlist[enumerate,`+l+`]{label=\arabic*.}
+`)
+	}
+}
+
+// renderPreambleTemplate writes the PreambleTemplate with its `{{title}}`,
+// `{{author}}` and `{{languages}}` tokens substituted.
+func (r *Renderer) renderPreambleTemplate(w io.Writer, title string) {
+	preamble := substituteVars([]byte(r.PreambleTemplate), map[string]string{
+		"title":     title,
+		"author":    r.authors(),
+		"languages": r.Languages,
+	})
+	w.Write(bytes.TrimRight(preamble, "\n"))
+	WriteByte(w, '\n')
+}
+
+// RenderHeader prints the LaTeX preamble if CompletePage is on.
+func (r *Renderer) RenderHeader(w io.Writer, ast *bf.Node) {
+	title := escapeString(r.Title)
+	if title == "" {
+		title = string(getTitle(ast))
+	}
+
+	r.skip = map[*bf.Node]bool{}
+	r.sectionOpen = false
+	r.findBibliography(ast)
+
+	r.orderedLists, r.starts = 0, listStarts(ast, r.source)
+
+	if r.Flags&CompletePage != 0 {
+		r.findAbstract(ast)
+
+		io.WriteString(w, `\documentclass{article}
+
+`)
+		if r.PreambleTemplate != "" {
+			r.renderPreambleTemplate(w, title)
+		} else {
+			r.renderPreamble(w, ast, title)
 		}
 
 		io.WriteString(w, `
 \begin{document}
 `)
+		if hook := strings.TrimSpace(r.BeginDocumentHook); hook != "" {
+			io.WriteString(w, hook+"\n")
+		}
 
 		if title != "" {
 			WriteString(w, `
 \maketitle
 `)
-			if r.Flags&TOC != 0 {
-				WriteString(w, `\vfill
+		}
+
+		if r.AbstractBeforeTOC {
+			r.renderAbstract(w)
+		}
+
+		// The toc, lof and lot directives place the lists in the body instead.
+		if title != "" && r.Flags&TOC != 0 && !hasDirective(ast, "toc", "lof", "lot") {
+			WriteString(w, `\vfill
 \thispagestyle{empty}
 
-\tableofcontents
 `)
-				if hasFigures(ast) {
-					io.WriteString(w, `\listoffigures
-`)
-				}
-				io.WriteString(w, `\clearpage
+			r.renderTOC(w)
+			if hasFigures(ast) {
+				io.WriteString(w, `\listoffigures
 `)
 			}
+			io.WriteString(w, `\clearpage
+`)
+		}
+
+		if !r.AbstractBeforeTOC {
+			r.renderAbstract(w)
 		}
 
 		io.WriteString(w, "\n\n")
-	} else if r.Flags&ChapterTitle != 0 && strings.TrimSpace(title) != "" {
-		io.WriteString(w, `\chapter{`+title+"}\n\n")
+
+		if r.BodyEnvironment != "" {
+			r.Env(w, r.BodyEnvironment, true, r.BodyEnvironmentArgs...)
+		}
+		if r.Columns > 1 {
+			r.Env(w, "multicols", true, strconv.Itoa(r.Columns))
+		}
+	} else if strings.TrimSpace(title) != "" {
+		switch {
+		case r.Flags&ChapterTitle != 0:
+			io.WriteString(w, `\chapter{`+title+"}\n\n")
+		case r.FragmentTitle == FragmentTitleSection:
+			io.WriteString(w, `\section*{`+title+"}\n\n")
+		case r.FragmentTitle == FragmentTitleBold:
+			io.WriteString(w, `\textbf{`+title+"}\n\n")
+		}
 	}
 }
 
 // RenderHeader prints the '\end{document}' if CompletePage is on.
 func (r *Renderer) RenderFooter(w io.Writer, ast *bf.Node) {
+	if r.sectionOpen {
+		io.WriteString(w, `\FloatBarrier`+"\n")
+	}
 	if r.Flags&CompletePage != 0 {
+		if r.Columns > 1 {
+			r.Env(w, "multicols", false)
+		}
+		if r.BodyEnvironment != "" {
+			r.Env(w, r.BodyEnvironment, false)
+		}
 		io.WriteString(w, `\end{document}`+"\n")
 	}
 }
 
 // Render prints out the whole document from the ast, header and footer included.
-func (r *Renderer) Render(w io.Writer, ast *bf.Node) {
-	r.RenderHeader(w, ast)
+// It returns the first error returned by w.
+func (r *Renderer) Render(w io.Writer, ast *bf.Node) error {
+	return r.RenderStream(w, ast)
+}
+
+// RenderStream prints out the whole document from the ast directly into w,
+// header and footer included, and returns the first write error. Rendering
+// stops as soon as a write fails.
+//
+// Nothing is buffered, so prefer it over RenderBytes for large documents:
+// holding the output in memory roughly doubles the memory needed to render.
+func (r *Renderer) RenderStream(w io.Writer, ast *bf.Node) error {
+	ew := &errWriter{w: w}
+	r.RenderHeader(ew, ast)
+	if ew.err != nil {
+		return ew.err
+	}
 	ast.Walk(func(node *bf.Node, entering bool) bf.WalkStatus {
-		if node.Type == bf.Heading && node.HeadingData.IsTitleblock {
+		if ew.err != nil {
+			return bf.Terminate
+		}
+		if node.Type == bf.Heading && node.HeadingData.IsTitleblock || r.skip[node] {
 			return bf.SkipChildren
 		}
-		return r.RenderNode(w, node, entering)
+		return r.RenderNode(ew, node, entering)
 	})
+	if ew.err != nil {
+		return ew.err
+	}
+	r.RenderFooter(ew, ast)
+	return ew.err
+}
 
-	r.RenderFooter(w, ast)
+// RenderBytes renders the whole document into memory and returns it. Use it
+// when the output bytes are needed afterwards, e.g. to write a tar entry;
+// otherwise RenderStream avoids the buffering.
+func (r *Renderer) RenderBytes(ast *bf.Node) []byte {
+	var buf bytes.Buffer
+	r.Render(&buf, ast)
+	return buf.Bytes()
 }
 
 // Run prints out the whole document with CompletePage and TOC flags enabled.
-func Run(w io.Writer, input []byte, opts ...bf.Option) {
-	renderer := &Renderer{Opts: Opts{Flags: CompletePage | TOC}}
+// A YAML frontmatter block at the start of input sets the document metadata.
+func Run(w io.Writer, input []byte, opts ...bf.Option) error {
+	fm, input, err := ParseFrontMatter(input)
+	if err != nil {
+		return err
+	}
+	rendererOpts := Opts{Flags: CompletePage | TOC, BreakURLs: true}
+	fm.Apply(&rendererOpts)
+	renderer := NewRenderer(rendererOpts)
 
 	optList := []bf.Option{bf.WithRenderer(renderer), bf.WithExtensions(bf.CommonExtensions)}
 	optList = append(optList, opts...)
 	parser := bf.New(optList...)
 	ast := parser.Parse(input)
-	renderer.Render(w, ast)
+	renderer.source = input
+	return renderer.Render(w, ast)
 }
@@ -1,9 +1,16 @@
 package pkg
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	bf "github.com/russross/blackfriday/v2"
+	"github.com/shopspring/decimal"
 )
 
 const input = `
@@ -68,20 +75,128 @@ type testData struct {
 	want  string
 	flags Flag
 	ext   bf.Extensions
+	opts  Opts
 }
 
 func runTest(t *testing.T, tdt []testData) {
 	for _, v := range tdt {
-		renderer := &Renderer{Opts: Opts{Flags: v.flags}}
+		opts := v.opts
+		opts.Flags |= v.flags
+		renderer := NewRenderer(opts)
 		md := bf.New(bf.WithRenderer(renderer), bf.WithExtensions(v.ext))
 		ast := md.Parse([]byte(v.input))
-		got := string(renderer.Render(ast))
+		renderer.source = []byte(v.input)
+		got := string(renderer.RenderBytes(ast))
 		if v.want != got {
 			t.Errorf("got %q, want %q", got, v.want)
 		}
 	}
 }
 
+func TestAbstract(t *testing.T) {
+	const doc = "% Title\n\nText"
+	for _, before := range []bool{false, true} {
+		got := render(doc, bf.Titleblock, Opts{Flags: TOC, Abstract: "About 100%.", AbstractBeforeTOC: before})
+		abstract := strings.Index(got, "\\begin{abstract}\nAbout 100\\%.\n\\end{abstract}")
+		toc := strings.Index(got, `\tableofcontents`)
+		if abstract < 0 || toc < 0 {
+			t.Fatalf("abstract or TOC not found in:\n%s", got)
+		}
+		if before != (abstract < toc) {
+			t.Errorf("AbstractBeforeTOC=%v: abstract at %d, TOC at %d", before, abstract, toc)
+		}
+	}
+
+	got := render("% Title\n\n# Abstract\n\nShort *summary*.\n\n# Intro\n\nText", bf.Titleblock, Opts{})
+	if !strings.Contains(got, "\\begin{abstract}\nShort \\emph{summary}.\n\\end{abstract}") {
+		t.Errorf("abstract section not rendered as abstract:\n%s", got)
+	}
+	if strings.Contains(got, "{Abstract}") {
+		t.Errorf("abstract heading rendered:\n%s", got)
+	}
+	if !strings.Contains(got, "{Intro}") || strings.Count(got, "Short") != 1 {
+		t.Errorf("unexpected body:\n%s", got)
+	}
+}
+
+func TestAuthors(t *testing.T) {
+	for _, v := range []struct {
+		opts Opts
+		want string
+	}{
+		{Opts{Author: "Jane & John"}, `\author{Jane \& John}`},
+		{
+			Opts{Author: "Ignored", Authors: []Author{{Name: "Ann", Affiliation: "ACME_1"}, {Name: "Bob"}}},
+			`\author{Ann\thanks{ACME\_1} \and Bob}`,
+		},
+	} {
+		if got := render("% Title\n\nText", bf.Titleblock, v.opts); !strings.Contains(got, v.want) {
+			t.Errorf("%s not found in:\n%s", v.want, got)
+		}
+	}
+}
+
+func TestBeginDocumentHook(t *testing.T) {
+	got := render("% Title\n\nText", bf.Titleblock, Opts{BeginDocumentHook: `\includegraphics{logo}`})
+	if want := "\\begin{document}\n\\includegraphics{logo}\n\n\\maketitle"; !strings.Contains(got, want) {
+		t.Errorf("%q not found in:\n%s", want, got)
+	}
+}
+
+func TestBibliography(t *testing.T) {
+	const doc = "# Intro\n\nText\n\n## References\n\n- Knuth, 1984\n\n# Appendix\n"
+	tdt := []testData{
+		{
+			input: doc,
+			want:  "\\chapter{Intro}\nText\n\n\\printbibliography[title={References}]\n\n\\chapter{Appendix}\n",
+			opts:  Opts{BibResource: "refs.bib"},
+		},
+		{
+			input: "# Intro\n\n# Bibliografia\n",
+			want:  "\\chapter{Intro}\n\\printbibliography[title={Bibliografia}]\n\n",
+			opts:  Opts{BibResource: "refs.bib", BibliographyHeading: "bibliografia"},
+		},
+		{
+			input: "# References\n",
+			want:  "\\chapter{References}\n",
+		},
+	}
+
+	runTest(t, tdt)
+
+	renderer := &Renderer{Opts: Opts{BibResource: "refs.bib"}}
+	ast := bf.New(bf.WithRenderer(renderer)).Parse([]byte("# References\n\nSee also the manual.\n\n- Knuth, 1984\n"))
+	if got, want := string(renderer.RenderBytes(ast)), "\\printbibliography[title={References}]\n\nSee also the manual.\n\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if warnings := renderer.Warnings(); len(warnings) != 1 || !strings.Contains(warnings[0], `list of the "References" section`) {
+		t.Errorf("got warnings %q", warnings)
+	}
+
+	if got := render(doc, 0, Opts{BibResource: "refs.bib"}); !strings.Contains(got, "\\usepackage{biblatex}\n\\addbibresource{refs.bib}\n") {
+		t.Errorf("bibliography resource not added:\n%s", got)
+	}
+}
+
+func TestBodyEnvironment(t *testing.T) {
+	got := render("% Title\n\nText\n", bf.Titleblock, Opts{BodyEnvironment: "multicols", BodyEnvironmentArgs: []string{"2"}})
+	if want := "\\begin{multicols}{2}\nText\n\\end{multicols}\n\n\\end{document}\n"; !strings.HasSuffix(got, want) {
+		t.Errorf("body not wrapped in multicols:\n%s", got)
+	}
+	if title, env := strings.Index(got, `\maketitle`), strings.Index(got, `\begin{multicols}`); title < 0 || env < title {
+		t.Errorf("body environment before the title:\n%s", got)
+	}
+}
+
+func TestCodeHighlights(t *testing.T) {
+	if got := render("```go hl=2\nx\ny\n```", bf.FencedCode, Opts{}); !strings.Contains(got, `\newcommand{\lsthl}`) {
+		t.Errorf("\\lsthl not defined in:\n%s", got)
+	}
+	if got := render("```go\nx\n```", bf.FencedCode, Opts{}); strings.Contains(got, `lstlinebgrd`) {
+		t.Errorf("lstlinebgrd loaded in:\n%s", got)
+	}
+}
+
 func TestCodeInline(t *testing.T) {
 	tdt := []testData{
 		{input: "`foo`", want: `\lstinline!foo!` + "\n"},
@@ -111,9 +226,226 @@ foo
 
 `,
 			ext: bf.FencedCode},
+		{
+			input: "``` go\n\n  \n  foo\n\n  bar\n\n\n```",
+			want: `\begin{lstlisting}[language=go]
+  foo
+
+  bar
+\end{lstlisting}
+
+`,
+			ext:  bf.FencedCode,
+			opts: Opts{TrimCodeBlankLines: true}},
+		{
+			input: "```tikz\n\\draw (0,0) -- (1,1);\n```",
+			want:  "\\begin{tikzpicture}\n\\draw (0,0) -- (1,1);\n\\end{tikzpicture}\n\n",
+			ext:   bf.FencedCode,
+		},
+		{
+			input: "```tikz\n\\begin{tikzpicture}\n\\draw (0,0) -- (1,1);\n\\end{tikzpicture}\n```",
+			want:  "\\begin{tikzpicture}\n\\draw (0,0) -- (1,1);\n\\end{tikzpicture}\n\n",
+			ext:   bf.FencedCode,
+		},
+		{
+			input: "```tikz\n\\draw (0,0) -- (1,1);\n```",
+			want:  "\\begin{lstlisting}[language=tikz]\n\\draw (0,0) -- (1,1);\n\\end{lstlisting}\n\n",
+			ext:   bf.FencedCode,
+			opts:  Opts{PassthroughLanguages: []string{}},
+		},
+		{
+			input: "```go caption=\"Main loop & more\" label=lst:main\nfor {}\n```",
+			want:  "\\begin{lstlisting}[language=go,caption={Main loop \\& more},label={lst:main}]\nfor {}\n\\end{lstlisting}\n\n",
+			ext:   bf.FencedCode,
+		},
+		{
+			input: "```go caption=Loop\nfor {}\n```",
+			want:  "\\begin{lstlisting}[language=go,caption={Loop}]\nfor {}\n\\end{lstlisting}\n\n",
+			ext:   bf.FencedCode,
+		},
+		{
+			input: "```go hl=1,3-5\nfor {}\n```",
+			want:  "\\begin{lstlisting}[language=go,linebackgroundcolor={\\lsthl{1}{1}\\lsthl{3}{5}}]\nfor {}\n\\end{lstlisting}\n\n",
+			ext:   bf.FencedCode,
+		},
+		{
+			input: "```go hl=3-1\nfor {}\n```",
+			want:  "\\begin{lstlisting}[language=go]\nfor {}\n\\end{lstlisting}\n\n",
+			ext:   bf.FencedCode,
+		},
+		{
+			input: "```math\nE = mc^2\n```",
+			want:  "\\[\nE = mc^2\n\\]\n\n",
+			ext:   bf.FencedCode,
+		},
+		{
+			input: "```math {#eq:energy}\nE = mc^2\n```",
+			want:  "\\begin{equation}\\label{eq:energy}\nE = mc^2\n\\end{equation}\n\n",
+			ext:   bf.FencedCode,
+		},
+	}
+
+	runTest(t, tdt)
+}
+
+func TestCodeBlockPassthroughLiteralRenderer(t *testing.T) {
+	// the nil PassthroughLanguages of a Renderer literal are the default ones
+	renderer := &Renderer{}
+	ast := bf.New(bf.WithRenderer(renderer), bf.WithExtensions(bf.FencedCode)).Parse([]byte("```tikz\n\\draw (0,0) -- (1,1);\n```"))
+	if got, want := string(renderer.RenderBytes(ast)), "\\begin{tikzpicture}\n\\draw (0,0) -- (1,1);\n\\end{tikzpicture}\n\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// render renders input as a complete page.
+func render(input string, ext bf.Extensions, opts Opts) string {
+	opts.Flags |= CompletePage
+	renderer := NewRenderer(opts)
+	md := bf.New(bf.WithRenderer(renderer), bf.WithExtensions(ext))
+	return string(renderer.RenderBytes(md.Parse([]byte(input))))
+}
+
+func TestColorSpans(t *testing.T) {
+	tdt := []testData{
+		{
+			input: `A <span style="color: red">warning</span>.`,
+			want:  "A \\textcolor{red}{warning}.\n",
+			opts:  Opts{EnableColorSpans: true},
+		},
+		{
+			input: `<span style="font-weight:bold;color:#ff00aa">a</span> <span class="b">b</span>`,
+			want:  "\\textcolor[HTML]{FF00AA}{a} b\n",
+			opts:  Opts{EnableColorSpans: true},
+		},
+		{
+			input: `A <mark>*highlight*</mark>.`,
+			want:  "A \\hl{\\emph{highlight}}.\n",
+			opts:  Opts{EnableColorSpans: true},
+		},
+		{
+			input: `A <span style="color:red">warning</span>.`,
+			want:  "A warning.\n",
+		},
+		{
+			input: `<span style="color:#f0a">a</span> <span style="color:#ff00aa00">b</span> <span style="color:#ggg">c</span>`,
+			want:  "\\textcolor[HTML]{FF00AA}{a} b c\n",
+			opts:  Opts{EnableColorSpans: true},
+		},
+		{
+			input: "A <span style=\"color:red\">*b*\n\nC <mark>d\n",
+			want:  "A \\textcolor{red}{\\emph{b}}\n\nC \\hl{d}\n",
+			opts:  Opts{EnableColorSpans: true},
+		},
+		{
+			input: "| <span style=\"color:red\">a | b |\n|---|---|\n| c | d |\n",
+			want:  "\\begin{center}\n\\begin{tabular}{ll}\n\\textbf{\\textcolor{red}{a}} & \\textbf{b} \\\\\n\\hline\nc & d \\\\\n\\end{tabular}\n\\end{center}\n\n",
+			ext:   bf.Tables,
+			opts:  Opts{EnableColorSpans: true},
+		},
+	}
+
+	runTest(t, tdt)
+
+	got := render("<mark>a</mark>", 0, Opts{EnableColorSpans: true})
+	if !strings.Contains(got, `\usepackage{xcolor}`) || !strings.Contains(got, `\usepackage{soul}`) {
+		t.Errorf("xcolor or soul not loaded:\n%s", got)
+	}
+}
+
+func TestColumns(t *testing.T) {
+	got := render("% Title\n\n# A\n\nText\n", bf.Titleblock, Opts{Columns: 2})
+	if !strings.Contains(got, `\usepackage{multicol}`) {
+		t.Errorf("multicol not loaded:\n%s", got)
+	}
+	if want := "\\begin{multicols}{2}\n\\chapter{A}\nText\n\\end{multicols}\n\n\\end{document}\n"; !strings.HasSuffix(got, want) {
+		t.Errorf("body not in two columns:\n%s", got)
+	}
+
+	got = render("% Title\n\n![a](x.png \"X\")\n\n![b](y.png)\n\n| a | b |\n|---|---|\n| c | d |\n",
+		bf.Titleblock|bf.Tables, Opts{Columns: 2, TableAutoWidth: true})
+	for _, want := range []string{
+		"\\begin{figure*}[!ht]\n\\begin{center}\n\\includegraphics[max width=\\textwidth, max height=\\textheight]{x}\n\\end{center}\n\\caption{X}\n\\end{figure*}\n",
+		"\\includegraphics[max width=\\linewidth, max height=\\textheight]{y}\n",
+		"\\begin{tabularx}{\\linewidth}{XX}\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%q not found in:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, `\begin{figure}`) {
+		t.Errorf("figure float in columns:\n%s", got)
+	}
+	if got := render("Text", 0, Opts{Columns: 1}); strings.Contains(got, `multicol`) {
+		t.Errorf("multicol used for one column:\n%s", got)
+	}
+}
+
+func TestDate(t *testing.T) {
+	const doc = "% Title\n\nText"
+	for _, v := range []struct {
+		date string
+		want string
+	}{
+		{"", "\\author{}\n\n\\begin{document}"},
+		{DateNone, "\\author{}\n\\date{}\n"},
+		{"April 6, 2022", "\\author{}\n\\date{April 6, 2022}\n"},
+		{"Q2_2022", "\\date{Q2\\_2022}\n"},
+		{DateToday, "\\date{\\today}\n"},
+	} {
+		got := render(doc, bf.Titleblock, Opts{Date: v.date})
+		if !strings.Contains(got, v.want) {
+			t.Errorf("date %q: %q not found in:\n%s", v.date, v.want, got)
+		}
+	}
+
+	now := time.Date(2022, time.April, 6, 0, 0, 0, 0, time.UTC)
+	got := render(doc, bf.Titleblock, Opts{Date: DateToday, DateFormat: "02/01/2006", Now: now})
+	if want := "\\date{06/04/2022}\n"; !strings.Contains(got, want) {
+		t.Errorf("%q not found in:\n%s", want, got)
+	}
+}
+
+func TestDisplayMath(t *testing.T) {
+	tdt := []testData{
+		{input: "$$ x^2 + y^2 = z^2 $$", want: "\\[\nx^2 + y^2 = z^2\n\\]\n"},
+		{input: "$$\nx < y & z\n$$\n\nText", want: "\\[\nx < y & z\n\\]\n\nText\n"},
+		{input: "Cost $$ 5", want: "Cost \\$\\$ 5\n"},
+		{input: "$$ *x* $$", want: "\\$\\$ \\emph{x} \\$\\$\n"},
+	}
+
+	runTest(t, tdt)
+}
+
+func TestDollarMath(t *testing.T) {
+	tdt := []testData{
+		{input: `Area $\pi r^2$, cost \$5.`, want: `Area $\pi r^2$, cost \$5.` + "\n", opts: Opts{DollarMath: true}},
+		{input: `From $5 to $10.`, want: `From \$5 to \$10.` + "\n", opts: Opts{DollarMath: true}},
+		{input: `Not $ x $ math.`, want: `Not \$ x \$ math.` + "\n", opts: Opts{DollarMath: true}},
+		{input: `Area $\pi r^2$.`, want: `Area \$\textbackslash{}pi r^2\$.` + "\n"},
+	}
+
+	runTest(t, tdt)
+}
+
+func TestEmoji(t *testing.T) {
+	tdt := []testData{
+		{input: `Hi :smile:!`, want: `Hi :smile:!` + "\n"},
+		{input: `Hi :smile:!`, want: `Hi \emoji{smile}!` + "\n", opts: Opts{EmojiMode: EmojiCommand, Engine: EngineLuaLaTeX}},
+		{input: `Hi :smile:!`, want: `Hi :)!` + "\n", opts: Opts{EmojiMode: EmojiText}},
+		{input: `Hi 😄!`, want: `Hi \emoji{smile}!` + "\n", opts: Opts{EmojiMode: EmojiCommand, Engine: EngineLuaLaTeX}},
+		// the emoji package needs LuaLaTeX
+		{input: `Hi :smile:!`, want: `Hi :)!` + "\n", opts: Opts{EmojiMode: EmojiCommand}},
+		{input: `a:b:c :unknown:`, want: `a:b:c :unknown:` + "\n", opts: Opts{EmojiMode: EmojiText}},
 	}
 
 	runTest(t, tdt)
+
+	if got := render(":smile:", 0, Opts{EmojiMode: EmojiCommand}); strings.Contains(got, `\usepackage{emoji}`) {
+		t.Errorf("emoji loaded without LuaLaTeX:\n%s", got)
+	}
+	if got := render(":smile:", 0, Opts{EmojiMode: EmojiCommand, Engine: EngineLuaLaTeX}); !strings.Contains(got, `\usepackage{emoji}`) {
+		t.Errorf("emoji not loaded with LuaLaTeX:\n%s", got)
+	}
 }
 
 func TestEmph(t *testing.T) {
@@ -131,6 +463,21 @@ func TestEmph(t *testing.T) {
 	runTest(t, tdt)
 }
 
+func TestEngine(t *testing.T) {
+	got := render("Text", 0, Opts{Engine: EngineXeLaTeX, MainFont: "Linux Libertine O"})
+	if !strings.Contains(got, `\usepackage{fontspec}`+"\n"+`\setmainfont{Linux Libertine O}`) {
+		t.Errorf("fontspec not loaded in:\n%s", got)
+	}
+	for _, no := range []string{"inputenc", "fontenc", `\DeclareUnicodeCharacter`} {
+		if strings.Contains(got, no) {
+			t.Errorf("%s found in:\n%s", no, got)
+		}
+	}
+	if got := render("Text", 0, Opts{MainFont: "Linux Libertine O"}); !strings.Contains(got, `\usepackage[utf8]{inputenc}`) || strings.Contains(got, "fontspec") {
+		t.Errorf("pdflatex preamble changed:\n%s", got)
+	}
+}
+
 func TestEscape(t *testing.T) {
 	tdt := []testData{
 		{input: `abcd#$%~_{}&`, want: `abcd\#\$\%\~\_\{\}\&` + "\n"},
@@ -141,6 +488,25 @@ func TestEscape(t *testing.T) {
 	runTest(t, tdt)
 }
 
+func TestFloatBarriers(t *testing.T) {
+	const doc = "# A\n\n![a](a.png \"Figure A\")\n\n# B\n\n![b](b.png \"Figure B\")\n"
+	got := render(doc, 0, Opts{FloatBarriers: true})
+	if !strings.Contains(got, `\usepackage{placeins}`) {
+		t.Errorf("placeins not loaded:\n%s", got)
+	}
+	body := got[strings.Index(got, `\begin{document}`):]
+	if n := strings.Count(body, `\FloatBarrier`); n != 2 {
+		t.Fatalf("got %d float barriers in:\n%s", n, body)
+	}
+	figA, barrier, b := strings.Index(body, `{Figure A}`), strings.Index(body, "\\FloatBarrier\n\\chapter{B}"), strings.Index(body, `{Figure B}`)
+	if figA < 0 || !(figA < barrier && barrier < b) || !strings.HasSuffix(body, "\\FloatBarrier\n\\end{document}\n") {
+		t.Errorf("float barriers not ending the sections:\n%s", body)
+	}
+	if got := render(doc, 0, Opts{}); strings.Contains(got, `FloatBarrier`) || strings.Contains(got, `placeins`) {
+		t.Errorf("float barriers by default:\n%s", got)
+	}
+}
+
 func TestFootnote(t *testing.T) {
 	tdt := []testData{
 		{
@@ -154,11 +520,59 @@ func TestFootnote(t *testing.T) {
 			want: `\footnote{bar}` + "\n\n",
 			ext:  bf.Footnotes,
 		},
+		{
+			input: `a[^a] b[^b]
+
+[^a]: first
+[^b]: second`,
+			want: `a\textsuperscript{1} b\textsuperscript{2}
+
+\section*{Notes}
+
+\begin{enumerate}
+\item first
+\item second
+\end{enumerate}
+
+`,
+			ext:  bf.Footnotes,
+			opts: Opts{FootnotesAsEndSection: true},
+		},
+		{
+			input: "a[^a]\n\n[^a]: first",
+			want:  `a\textsuperscript{[1]}\footnotetext[1]{first}` + "\n\n",
+			ext:   bf.Footnotes,
+			opts:  Opts{BracketedFootnoteMarks: true},
+		},
 	}
 
 	runTest(t, tdt)
 }
 
+func TestGeometryOptions(t *testing.T) {
+	for _, v := range []struct {
+		opts string
+		want string
+	}{
+		{"", `\usepackage[margin=1in]{geometry}`},
+		{"a4paper,left=2cm,right=2cm", `\usepackage[a4paper,left=2cm,right=2cm]{geometry}`},
+		{GeometryNone, ""},
+	} {
+		got := render("Text", 0, Opts{GeometryOptions: v.opts})
+		if v.want == "" && strings.Contains(got, "geometry") || !strings.Contains(got, v.want) {
+			t.Errorf("%q: %s not found in:\n%s", v.opts, v.want, got)
+		}
+	}
+
+	var buf strings.Builder
+	if err := Run(&buf, []byte("Text")); err != nil {
+		t.Fatal(err)
+	}
+	if want := `\usepackage[margin=1in]{geometry}`; !strings.Contains(buf.String(), want) {
+		t.Errorf("Run: %s not found in:\n%s", want, buf.String())
+	}
+}
+
 func TestHardbreak(t *testing.T) {
 	tdt := []testData{
 		{
@@ -167,19 +581,95 @@ bar`, want: `foo~\\
 bar
 `,
 			ext: bf.HardLineBreak},
+		{
+			input: "foo\nbar",
+			want:  "foo\\newline\nbar\n",
+			ext:   bf.HardLineBreak,
+			opts:  Opts{HardbreakCommand: `\newline`},
+		},
+	}
+
+	runTest(t, tdt)
+}
+
+func TestHeadingMap(t *testing.T) {
+	opts := Opts{HeadingMap: []string{"part", "chapter"}}
+	tdt := []testData{
+		{input: `# foo`, want: `\part{foo}` + "\n", opts: opts},
+		{input: `## foo`, want: `\chapter{foo}` + "\n", opts: opts},
+		{input: `### foo`, want: `\textbf{foo}` + "\n", opts: opts},
+	}
+
+	runTest(t, tdt)
+}
+
+func TestHeadingMapValidate(t *testing.T) {
+	for i, v := range []struct {
+		opts Opts
+		err  string
+	}{
+		{Opts{HeadingMap: []string{"part", "chapter"}}, ""},
+		{Opts{HeadingMap: []string{"part", ""}}, `invalid command "" of the level 2`},
+		{Opts{HeadingMap: []string{`\part`}}, `invalid command "\\part" of the level 1`},
+		{Opts{HeadingMap: make([]string, 7)}, "7 commands, but the headings have 6 levels at most"},
+		{Opts{MainLanguage: "spanish-mexico"}, ""},
+		{Opts{TableBorderPreset: "thick"}, `unknown table border preset "thick"`},
+		{Opts{MainLanguage: "english}\\input{x}"}, `invalid main language "english}\\input{x}"`},
+	} {
+		err := v.opts.Validate()
+		if v.err == "" && err != nil || v.err != "" && (err == nil || !strings.Contains(err.Error(), v.err)) {
+			t.Errorf("%d: got error %v, want %q", i, err, v.err)
+		}
+	}
+}
+
+func TestHeadingOffset(t *testing.T) {
+	tdt := []testData{
+		{input: `# foo`, want: `\section{foo}` + "\n", opts: Opts{HeadingOffset: 1}},
+		{input: `## foo`, want: `\subsection{foo}` + "\n", opts: Opts{HeadingOffset: 1}},
+		{input: `# foo`, want: `\subsection{foo}` + "\n", opts: Opts{HeadingOffset: 2}},
+		{input: `### foo`, want: `\paragraph{foo} `, opts: Opts{HeadingOffset: 2}},
+		{input: `##### foo`, want: `\textbf{foo} `, opts: Opts{HeadingOffset: 2}},
+	}
+
+	runTest(t, tdt)
+}
+
+func TestHighlight(t *testing.T) {
+	tdt := []testData{
+		{input: `a ==b & c== d`, want: "a \\hl{b \\& c} d\n", opts: Opts{Highlight: true}},
+		{input: `==a== and ==b==`, want: "\\hl{a} and \\hl{b}\n", opts: Opts{Highlight: true}},
+		{input: `a == b, c ==d`, want: "a == b, c ==d\n", opts: Opts{Highlight: true}},
+		{input: `==a==`, want: "==a==\n"},
 	}
 
 	runTest(t, tdt)
+
+	got := render("==a==", 0, Opts{Highlight: true, HighlightColor: "green!20"})
+	if !strings.Contains(got, "\\usepackage{soul}\n\\sethlcolor{green!20}\n") {
+		t.Errorf("soul not loaded with the highlight color:\n%s", got)
+	}
 }
 
 func TestHRule(t *testing.T) {
 	tdt := []testData{
 		{input: `---`, want: `\HRule{}` + "\n"},
+		{input: `---`, want: `\vspace{1em}\hrule` + "\n", opts: Opts{HorizontalRuleCommand: `\vspace{1em}\hrule`}},
+		{input: `---`, want: `\newpage` + "\n", opts: Opts{HRuleAsNewPage: true}},
 	}
 
 	runTest(t, tdt)
 }
 
+func TestHRuleDefinition(t *testing.T) {
+	if got := render("---", 0, Opts{}); !strings.Contains(got, `\newcommand{\HRule}`) {
+		t.Errorf("\\HRule not defined:\n%s", got)
+	}
+	if got := render("---", 0, Opts{HorizontalRuleCommand: `\HRule`}); strings.Contains(got, `\newcommand{\HRule}`) {
+		t.Errorf("\\HRule defined for a custom command:\n%s", got)
+	}
+}
+
 func TestImage(t *testing.T) {
 	tdt := []testData{
 		{
@@ -205,6 +695,10 @@ func TestImage(t *testing.T) {
 
 `,
 		},
+		{
+			input: `[![Image 1](foobar.jpg "foo")](http://example.com)`,
+			want:  `\href{http://example.com}{\includegraphics[max width=\textwidth, max height=\textheight]{foobar}}` + "\n",
+		},
 	}
 
 	runTest(t, tdt)
@@ -245,13 +739,144 @@ func TestLink(t *testing.T) {
 			ext:   bf.Autolink,
 			flags: SkipLinks,
 		},
+		{
+			input: `[foo](mailto:doe@example.com)`,
+			want:  `\href{mailto:doe@example.com}{foo}` + "\n",
+			flags: Safelink,
+		},
+		{
+			input: `[foo](ftp://example.com)`,
+			want:  `foo\footnote{\nolinkurl{ftp://example.com}}` + "\n",
+			flags: Safelink,
+		},
+		{
+			input: `[foo](ftp://example.com)`,
+			want:  `\href{ftp://example.com}{foo}` + "\n",
+			flags: Safelink,
+			opts:  Opts{TrustedProtocols: []string{"ftp"}},
+		},
+		{
+			input: `[call](tel:+15550100)`,
+			want:  `\href{tel:+15550100}{call}` + "\n",
+			flags: Safelink,
+			opts:  Opts{TrustedProtocols: []string{"https", "tel"}},
+		},
+		{
+			input: `[foo](javascript:void)`,
+			want:  `foo\footnote{\nolinkurl{javascript:void}}` + "\n",
+			flags: Safelink,
+		},
+		{
+			input: `https://www.example.com/some/very/long/path/to/a_page?with=query`,
+			want:  `\href{https://www.example.com/some/very/long/path/to/a_page?with=query}{www.example.com\ldots{}}` + "\n",
+			ext:   bf.Autolink,
+			opts:  Opts{ShortenAutolinks: true},
+		},
+		{
+			input: `[foo](http://example.com)`,
+			want:  `\href{http://example.com}{foo}` + "\n",
+			opts:  Opts{ShortenAutolinks: true},
+		},
+		{
+			input: `<doe@example.com>`,
+			want:  `\href{mailto:doe@example.com}{\email{doe@example.com}}` + "\n",
+			ext:   bf.Autolink,
+			opts:  Opts{EmailCommand: "email"},
+		},
+		{
+			input: `[John](mailto:doe@example.com)`,
+			want:  `\href{mailto:doe@example.com}{John}` + "\n",
+			opts:  Opts{EmailCommand: "email"},
+		},
+		{
+			input: `[foo](docs/intro.md)`,
+			want:  `\href{docs/intro.md}{foo}` + "\n",
+		},
+		{
+			input: `[foo](docs/intro.md)`,
+			want:  "foo\n",
+			opts:  Opts{RelativeLinksAsText: true},
+		},
+		{
+			input: `[foo](#intro)`,
+			want:  `\href{#intro}{foo}` + "\n",
+			opts:  Opts{RelativeLinksAsText: true},
+		},
 	}
 
 	runTest(t, tdt)
 }
 
+func TestLinkSafelinkLiteralRenderer(t *testing.T) {
+	// the nil TrustedProtocols of a Renderer literal are the default ones
+	renderer := &Renderer{Opts: Opts{Flags: Safelink}}
+	ast := bf.New(bf.WithRenderer(renderer)).Parse([]byte(`[foo](https://example.com)`))
+	if got, want := string(renderer.RenderBytes(ast)), `\href{https://example.com}{foo}`+"\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRelativeLinkWarnings(t *testing.T) {
+	renderer := NewRenderer(Opts{})
+	md := bf.New(bf.WithRenderer(renderer))
+	renderer.RenderBytes(md.Parse([]byte("[intro](docs/intro.md), [top](#top) and [site](https://example.com)")))
+	want := []string{`relative link "intro" to "docs/intro.md"`}
+	if got := renderer.Warnings(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestHyperrefOptions(t *testing.T) {
+	want := "\\hypersetup{colorlinks,\n\tcitecolor=black,\n\tfilecolor=black,\n\tlinkcolor=black,\n\tlinktoc=page,\n\turlcolor=black,\n\tpdfstartview=FitH,\n\tbreaklinks=true,\n\tpdfcreator={Blackfriday Markdown Processor v" + bf.Version + "},\n}\n"
+	if got := render("Text", 0, Opts{}); !strings.Contains(got, want) {
+		t.Errorf("%s not found in:\n%s", want, got)
+	}
+
+	got := render("Text", 0, Opts{
+		Author:          "Jane & John",
+		HyperrefOptions: map[string]string{"colorlinks": "false", "linkcolor": "blue", "bookmarksopen": "true"},
+	})
+	for _, want := range []string{`\hypersetup{colorlinks=false,`, "\tlinkcolor=blue,\n", "\tbookmarksopen=true,\n\tpdfauthor={Jane \\& John},\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%q not found in:\n%s", want, got)
+		}
+	}
+}
+
+func TestKeywords(t *testing.T) {
+	got := render("% Title\n\nText", bf.Titleblock, Opts{Abstract: "About.", Keywords: []string{"C#", "LaTeX"}})
+	if !strings.Contains(got, `\providecommand{\keywords}`) {
+		t.Errorf("\\keywords not provided in:\n%s", got)
+	}
+	abstract := strings.Index(got, `\end{abstract}`)
+	keywords := strings.Index(got, `\keywords{C\#, LaTeX}`)
+	if abstract < 0 || keywords < abstract {
+		t.Errorf("keywords not rendered after the abstract in:\n%s", got)
+	}
+}
+
 func TestList(t *testing.T) {
 	tdt := []testData{
+		{
+			input: "* a\n    1. b\n        * c\n        * d\n    2. e\n* f\n",
+			want: `\begin{itemize}
+\item a
+
+\begin{enumerate}
+\item b
+
+\begin{itemize}
+\item c
+\item d
+\end{itemize}
+
+\item e
+\end{enumerate}
+
+\item f
+\end{itemize}
+
+`},
 		{
 			input: `* foo
 * bar`,
@@ -282,6 +907,22 @@ baz
 \end{description}
 
 `, ext: bf.DefinitionLists},
+		{
+			input: "`a[0]_b`\n: qux",
+			want: `\begin{description}
+\item [\texttt{a[0]\_b}] qux
+\end{description}
+
+`, ext: bf.DefinitionLists},
+		{
+			input: "foo\n: bar\n\nbaz\n: qux\n: quux",
+			want: `\begin{tabular}{lp{0.6\textwidth}}
+foo & bar \\
+baz & qux \\
+ & quux \\
+\end{tabular}
+
+`, ext: bf.DefinitionLists, opts: Opts{DefinitionListAsTable: true}},
 		{
 			input: `foo
 : bar
@@ -294,11 +935,225 @@ baz
 baz
 : qux
 `},
-	}
+		{
+			input: `1. one
+   * a
+     1. x
+     2. y
+   * b
+2. two
+3. three`,
+			want: `\begin{enumerate}
+\item one
+
+\begin{itemize}
+\item a
+
+\begin{enumerate}
+\item x
+\item y
+\end{enumerate}
+
+\item b
+\end{itemize}
+
+\item two
+\item three
+\end{enumerate}
+
+`},
+	}
 
 	runTest(t, tdt)
 }
 
+func TestListDepth(t *testing.T) {
+	var deep strings.Builder
+	for i := 0; i < 6; i++ {
+		deep.WriteString(strings.Repeat("    ", i) + "* level\n")
+	}
+	got := render(deep.String(), 0, Opts{})
+	for _, want := range []string{`\usepackage{enumitem}`, `\setlistdepth{6}`, `\renewlist{itemize}{itemize}{6}`, `\setlist[itemize,6]{label=\textbullet}`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%s not found in:\n%s", want, got)
+		}
+	}
+	if got := render("* a\n    * b\n        * c\n", 0, Opts{}); strings.Contains(got, "enumitem") {
+		t.Errorf("enumitem loaded in:\n%s", got)
+	}
+}
+
+func TestListStart(t *testing.T) {
+	tdt := []testData{
+		{
+			input: "5. foo\n6. bar\n",
+			want: `\begin{enumerate}
+\setcounter{enumi}{4}
+\item foo
+\item bar
+\end{enumerate}
+
+`},
+		{
+			input: "1. foo\n    3. bar\n    4. baz\n2. qux\n",
+			want: `\begin{enumerate}
+\item foo
+
+\begin{enumerate}
+\setcounter{enumii}{2}
+\item bar
+\item baz
+\end{enumerate}
+
+\item qux
+\end{enumerate}
+
+`},
+		{
+			input: "```\n3. code\n```\n\n- a\n- b\n\n7. foo\n",
+			want:  "\\begin{lstlisting}[language=]\n3. code\n\\end{lstlisting}\n\n\\begin{itemize}\n\\item a\n\\item b\n\\end{itemize}\n\n\\begin{enumerate}\n\\setcounter{enumi}{6}\n\\item foo\n\\end{enumerate}\n\n",
+			ext:   bf.FencedCode,
+		},
+	}
+
+	runTest(t, tdt)
+
+	source := "2. a\n\ntext\n\n> 3. **b**\n\n1. a\n"
+	ast := bf.New().Parse([]byte(source))
+	if got := listStarts(ast, []byte(source)); len(got) != 3 || got[0] != 2 || got[1] != 3 || got[2] != 1 {
+		t.Errorf("got the starts %v, want [2 3 1]", got)
+	}
+
+	// a list missing from the source, like the ones of included files
+	ast = bf.New().Parse([]byte("5. included\n\ntext\n\n4. b\n"))
+	if got := listStarts(ast, []byte("text\n\n4. b\n")); len(got) != 2 || got[0] != 1 || got[1] != 4 {
+		t.Errorf("got the starts %v, want [1 4]", got)
+	}
+}
+
+func TestListingName(t *testing.T) {
+	const doc = "Text\n\n    code"
+	got := render(doc, 0, Opts{ListingName: "Code", ListingUnnumbered: true})
+	for _, want := range []string{`\renewcommand{\lstlistingname}{Code}`, `\captionsetup[lstlisting]{labelformat=unnumbered}`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%s not found in:\n%s", want, got)
+		}
+	}
+	if got := render(doc, 0, Opts{}); strings.Contains(got, "lstlistingname") || strings.Contains(got, "captionsetup") {
+		t.Errorf("listing captions changed by default:\n%s", got)
+	}
+}
+
+func TestNumberWithinSection(t *testing.T) {
+	got := render("# A\n\n![x](x.png)\n", 0, Opts{NumberWithinSection: true})
+	for _, want := range []string{`\usepackage{amsmath}`, "\\numberwithin{figure}{section}\n\\numberwithin{table}{section}\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%q not found in:\n%s", want, got)
+		}
+	}
+	if got := render("# A\n", 0, Opts{}); strings.Contains(got, `\numberwithin`) {
+		t.Errorf("numbered within sections by default:\n%s", got)
+	}
+}
+
+func TestParagraphSpacing(t *testing.T) {
+	for _, v := range []struct {
+		opts Opts
+		want []string
+		no   []string
+	}{
+		{Opts{}, []string{`\addtolength{\parskip}{0.5\baselineskip}`}, []string{"parindent"}},
+		{Opts{ParSkip: "6pt", ParIndent: "1.5em"}, []string{`\setlength{\parskip}{6pt}`, `\setlength{\parindent}{1.5em}`}, []string{"addtolength"}},
+		{Opts{ParSkip: ParSkipPackage, ParIndent: "0pt"}, []string{`\usepackage{parskip}`, `\parindent=0pt`}, []string{"addtolength", "setlength"}},
+		{Opts{Flags: NoParIndent, ParIndent: "1.5em"}, []string{`\parindent=0pt`}, []string{"1.5em"}},
+	} {
+		got := render("Text", 0, v.opts)
+		for _, want := range v.want {
+			if !strings.Contains(got, want) {
+				t.Errorf("%+v: %s not found in:\n%s", v.opts, want, got)
+			}
+		}
+		for _, no := range v.no {
+			if strings.Contains(got, no) {
+				t.Errorf("%+v: %s found in:\n%s", v.opts, no, got)
+			}
+		}
+	}
+}
+
+func TestPassthroughPackages(t *testing.T) {
+	got := render("```tikz\n\\draw (0,0) -- (1,1);\n```\n\n```go\nx\n```", bf.FencedCode, Opts{})
+	if !strings.Contains(got, `\usepackage{tikz}`) || strings.Contains(got, `\usepackage{asymptote}`) {
+		t.Errorf("passthrough packages not loaded as used in:\n%s", got)
+	}
+}
+
+func TestPreamblePackages(t *testing.T) {
+	for _, v := range []struct {
+		input string
+		want  []string
+		no    []string
+	}{
+		{"Text", nil, []string{"amsmath", "adjustbox", "listings", "lstset", "ulem"}},
+		{"`code`", []string{`\usepackage{listings}`, `\lstset{`}, []string{"amsmath", "adjustbox"}},
+		{"```math\nx\n```", []string{`\usepackage{amsmath}`}, []string{"listings"}},
+		{"![alt](a.png)", []string{`\usepackage[export]{adjustbox}`}, []string{"listings"}},
+		{"<!-- ::\n\\raw\n-->\n\nText", []string{"amsmath", "adjustbox", "listings", "ulem"}, nil},
+		{"Text <!--tex \\raw -->", []string{"amsmath", "adjustbox", "listings", "ulem"}, nil},
+		{"<!-- div warning -->\n\nText\n\n<!-- /div -->", []string{"amsmath", "adjustbox", "listings", "ulem"}, nil},
+		{"<!-- div note -->\n\nText\n\n<!-- /div -->", nil, []string{"amsmath", "adjustbox", "listings", "ulem"}},
+	} {
+		got := render(v.input, bf.FencedCode, Opts{DivEnvironments: map[string]string{"warning": "mdframed"}})
+		for _, want := range v.want {
+			if !strings.Contains(got, want) {
+				t.Errorf("%q: %s not found in:\n%s", v.input, want, got)
+			}
+		}
+		for _, no := range v.no {
+			if strings.Contains(got, no) {
+				t.Errorf("%q: %s found in:\n%s", v.input, no, got)
+			}
+		}
+	}
+}
+
+func TestPreamblePackagesHtmlBlockHandler(t *testing.T) {
+	handler := func(r *Renderer, w io.Writer, node *bf.Node, entering bool) bf.WalkStatus {
+		io.WriteString(w, `\raw`)
+		return bf.GoToNext
+	}
+	got := render("<div>Text</div>", 0, Opts{HtmlBlockHandler: handler})
+	for _, want := range []string{"amsmath", "adjustbox", "listings", "ulem"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%s not found in:\n%s", want, got)
+		}
+	}
+}
+
+func TestPDFMetadata(t *testing.T) {
+	got := render("% Title & more\n% on two lines\n\nText", bf.Titleblock, Opts{Author: "Jane Doe"})
+	setup := got[strings.Index(got, `\hypersetup{`):]
+	setup = setup[:strings.Index(setup, "\n}\n")]
+	for _, want := range []string{"pdfauthor={Jane Doe}", `pdftitle={Title \& more on two lines}`, "pdfcreator={Blackfriday Markdown Processor v"} {
+		if !strings.Contains(setup, want) {
+			t.Errorf("%s not found in:\n%s", want, setup)
+		}
+	}
+}
+
+func TestPreambleTemplate(t *testing.T) {
+	got := render("% Title & more\n\nText", bf.Titleblock, Opts{
+		Author:           "Jane Doe",
+		Languages:        "english",
+		GeometryOptions:  "a4paper",
+		PreambleTemplate: "\\usepackage[{{languages}}]{babel}\n\\title{{{title}}}\n\\author{{{author}}}\n\n",
+	})
+	want := "\\documentclass{article}\n\n\\usepackage[english]{babel}\n\\title{Title \\& more}\n\\author{Jane Doe}\n\n\\begin{document}\n"
+	if !strings.HasPrefix(got, want) {
+		t.Errorf("got:\n%s\nwant prefix:\n%s", got, want)
+	}
+}
+
 func TestQuotation(t *testing.T) {
 	tdt := []testData{
 		{
@@ -308,28 +1163,150 @@ Quote
 \end{quotation}
 
 `},
+		{
+			input: "> Quote\n> -- A & B",
+			want:  "\\epigraph{Quote}{A \\& B}\n\n",
+			opts:  Opts{EnvQuotationAttributed: "epigraph"},
+		},
+		{
+			input: `> Quote`,
+			want: `\begin{quotation}
+Quote
+\end{quotation}
+
+`,
+			opts: Opts{EnvQuotationAttributed: "epigraph"},
+		},
+		{
+			input: "> Outer\n>\n> > Inner\n> > -- A\n",
+			want: `\begin{quotation}
+Outer
+
+\begin{quotation}{A}
+Inner
+\end{quotation}
+
+\end{quotation}
+
+`},
+		{
+			input: "> Quote\n> -- O'Brien & Co_1",
+			want: `\begin{quotation}{O’Brien \& Co\_1}
+Quote
+\end{quotation}
+
+`},
+		{
+			input: "> > Inner\n>\n> -- A\n",
+			want: `\begin{quotation}{A}
+\begin{quotation}
+Inner
+\end{quotation}
+
+\end{quotation}
+
+`},
+		{
+			input: "> -- A",
+			want: `\begin{quotation}
+-- A
+\end{quotation}
+
+`},
+		{
+			input: ">",
+			want:  "\\begin{quotation}\n\\end{quotation}\n\n",
+		},
+		{
+			input: "> Citação\n> -- Autor",
+			want:  "\\begin{foreigndisplayquote}{brazil}[Autor]\nCitação\n\\end{foreigndisplayquote}\n\n",
+			opts:  Opts{Languages: "english, brazil", LanguageQuotes: true},
+		},
+		{
+			input: `> Quote`,
+			want:  "\\begin{foreigndisplayquote}{french}\nQuote\n\\end{foreigndisplayquote}\n\n",
+			opts:  Opts{Languages: "english,brazil", MainLanguage: "french", LanguageQuotes: true},
+		},
 	}
 
 	runTest(t, tdt)
 }
 
+func TestQuotationRenderTwice(t *testing.T) {
+	for _, input := range []string{"> Quote\n> -- A", "> Quote\n>\n> -- A"} {
+		renderer := NewRenderer(Opts{})
+		ast := bf.New(bf.WithRenderer(renderer)).Parse([]byte(input))
+		first := string(renderer.RenderBytes(ast))
+		if !strings.Contains(first, "{A}") {
+			t.Errorf("%q: no attribution in %q", input, first)
+		}
+		if second := string(renderer.RenderBytes(ast)); second != first {
+			t.Errorf("%q: got %q on the second render, want %q", input, second, first)
+		}
+	}
+}
+
 func TestQuote(t *testing.T) {
 	tdt := []testData{
-		{input: `"foo"`, want: `\enquote{foo}` + "\n"},
+		{input: `"foo"`, want: `"foo"` + "\n"},
 	}
 
 	runTest(t, tdt)
 }
 
+var errWriteFailed = errors.New("write failed")
+
+// failingWriter accepts n bytes and fails on every write after them.
+type failingWriter struct {
+	n int
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > f.n {
+		n := f.n
+		f.n = 0
+		return n, errWriteFailed
+	}
+	f.n -= len(p)
+	return len(p), nil
+}
+
+func TestRenderWriteError(t *testing.T) {
+	renderer := NewRenderer(Opts{Flags: CompletePage})
+	md := bf.New(bf.WithRenderer(renderer), bf.WithExtensions(bf.CommonExtensions))
+	ast := md.Parse([]byte(input))
+	full := len(renderer.RenderBytes(ast))
+
+	for _, n := range []int{0, 10, full / 2, full - 1} {
+		if err := renderer.Render(&failingWriter{n: n}, ast); err != errWriteFailed {
+			t.Errorf("fail after %d bytes: got %v, want %v", n, err, errWriteFailed)
+		}
+	}
+	if err := renderer.Render(&failingWriter{n: full}, ast); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+}
+
+func TestSecNumDepth(t *testing.T) {
+	const doc = "% Title\n\nText"
+	got := render(doc, bf.Titleblock, Opts{SecNumDepth: 2})
+	if want := "\\setcounter{secnumdepth}{2}\n"; !strings.Contains(got, want) {
+		t.Errorf("%q not found in:\n%s", want, got)
+	}
+	if got := render(doc, bf.Titleblock, Opts{}); strings.Contains(got, "secnumdepth") {
+		t.Errorf("secnumdepth set by default:\n%s", got)
+	}
+}
+
 func TestSection(t *testing.T) {
 	tdt := []testData{
-		{input: `#foo`, want: `\section{foo}` + "\n"},
-		{input: `# foo`, want: `\section{foo}` + "\n"},
-		{input: `## foo`, want: `\subsection{foo}` + "\n"},
-		{input: `### foo`, want: `\subsubsection{foo}` + "\n"},
-		{input: `#### foo`, want: `\paragraph{foo} `},
-		{input: `##### foo`, want: `\subparagraph{foo} `},
-		{input: `###### foo`, want: `\textbf{foo} `},
+		{input: `#foo`, want: `\chapter{foo}` + "\n"},
+		{input: `# foo`, want: `\chapter{foo}` + "\n"},
+		{input: `## foo`, want: `\section{foo}` + "\n"},
+		{input: `### foo`, want: `\subsection{foo}` + "\n"},
+		{input: `#### foo`, want: `\subsubsection{foo} `},
+		{input: `##### foo`, want: `\paragraph{foo} `},
+		{input: `###### foo`, want: `\subparagraph{foo} `},
 	}
 
 	runTest(t, tdt)
@@ -339,13 +1316,124 @@ func TestStrikethrough(t *testing.T) {
 	tdt := []testData{
 		{input: `~~foo~~`, want: `\~\~foo\~\~` + "\n"},
 		{input: `~~foo~~`, want: `\sout{foo}` + "\n", ext: bf.Strikethrough},
+		{input: `~~**foo** bar~~`, want: `\sout{\mbox{\textbf{foo} bar}}` + "\n", ext: bf.Strikethrough},
 	}
 
 	runTest(t, tdt)
 }
 
+func TestStrikethroughPackage(t *testing.T) {
+	if got := render("~~foo~~", bf.Strikethrough, Opts{}); !strings.Contains(got, `\usepackage[normalem]{ulem}`) {
+		t.Errorf("ulem not loaded in:\n%s", got)
+	}
+	if got := render("foo", bf.Strikethrough, Opts{}); strings.Contains(got, `ulem`) {
+		t.Errorf("ulem loaded in:\n%s", got)
+	}
+}
+
+func TestTOCDepth(t *testing.T) {
+	const doc = "% Title\n\nText"
+	got := render(doc, bf.Titleblock, Opts{Flags: TOC, TOCDepth: 2})
+	if want := "\\setcounter{tocdepth}{2}\n\\tableofcontents\n"; !strings.Contains(got, want) {
+		t.Errorf("%q not found in:\n%s", want, got)
+	}
+	if got := render(doc, bf.Titleblock, Opts{Flags: TOC, TOCDepth: -1}); strings.Contains(got, "tocdepth") {
+		t.Errorf("tocdepth set by default:\n%s", got)
+	}
+}
+
 func TestTable(t *testing.T) {
 	tdt := []testData{
+		{
+			// the escaped & and \ don't end the cell or the row
+			input: "| a & b | c \\ d |\n|---|---|\n| x\\y | \\\\ |\n",
+			want: `\begin{center}
+\begin{tabular}{ll}
+\textbf{a \& b} & \textbf{c \textbackslash{} d} \\
+\hline
+x\textbackslash{}y & \textbackslash{} \\
+\end{tabular}
+\end{center}
+
+`,
+			ext: bf.Tables,
+		},
+		{
+			input: "| a | b | c |\n|---|:-:|--:|\n| d | e | f |\n",
+			want: `\begin{center}
+\begin{tabularx}{\textwidth}{X>{\centering\arraybackslash}X>{\raggedleft\arraybackslash}X}
+\textbf{a} & \textbf{b} & \textbf{c} \\
+\hline
+d & e & f \\
+\end{tabularx}
+\end{center}
+
+`,
+			ext:  bf.Tables,
+			opts: Opts{TableAutoWidth: true},
+		},
+		{
+			input: "| a | b |\n|---|---|\n| c | d |\n",
+			want: `\begin{center}
+\rowcolors{2}{blue!5}{white}
+\begin{tabular}{ll}
+\textbf{a} & \textbf{b} \\
+\hline
+c & d \\
+\end{tabular}
+\end{center}
+
+`,
+			ext:  bf.Tables,
+			opts: Opts{TableZebra: true, TableZebraColors: [2]string{"blue!5"}},
+		},
+		{
+			input: "| a | b |\n|---|---|\n| c | d |\n",
+			want: `\begin{center}
+\begin{tabular}{|ll|}
+\hline
+\textbf{a} & \textbf{b} \\
+\hline
+c & d \\
+\hline
+\end{tabular}
+\end{center}
+
+`,
+			ext:  bf.Tables,
+			opts: Opts{TableBorderPreset: "outer"},
+		},
+		{
+			input: "| a | b |\n|---|---|\n| c | d |\n",
+			want: `\begin{center}
+\begin{tabular}{ll}
+\textbf{a} & \textbf{b} \\
+\hline
+c & d \\
+\end{tabular}
+\end{center}
+
+`,
+			ext:  bf.Tables,
+			opts: Opts{TableBorderPreset: "none"},
+		},
+		{
+			input: "| a | b |\n|---|---|\n| c | d |\n| e | f |\n",
+			want: `\begin{center}
+\begin{tabular}{|l|l|}
+\hline
+\textbf{a} & \textbf{b} \\
+\hline
+c & d \\ \hline
+e & f \\
+\hline
+\end{tabular}
+\end{center}
+
+`,
+			ext:  bf.Tables,
+			opts: Opts{TableBorderPreset: "all"},
+		},
 		{
 			input: `
 | default | left | center | right |
@@ -374,11 +1462,139 @@ foo & bar & baz & qux \\
 | foo     |
 `,
 		},
+		{
+			input: `
+| a | b |
+|---|---|
+| col1<br>col1b | col2 |
+`,
+			want: `\begin{center}
+\begin{tabular}{ll}
+\textbf{a} & \textbf{b} \\
+\hline
+col1 col1b & col2 \\
+\end{tabular}
+\end{center}
+
+`,
+			ext: bf.Tables,
+		},
+		{
+			input: `
+| a | b |
+|---|---|
+| col1<br>col1b | col2 |
+`,
+			want: `\begin{center}
+\begin{tabularx}{\textwidth}{XX}
+\textbf{a} & \textbf{b} \\
+\hline
+col1\newline col1b & col2 \\
+\end{tabularx}
+\end{center}
+
+`,
+			ext:  bf.Tables,
+			opts: Opts{TableAutoWidth: true},
+		},
+		{
+			input: `
+| a | b |
+|---|---|
+| foo <!-- x --> | bar |
+`,
+			want: `\begin{center}
+\begin{tabular}{ll}
+\textbf{a} & \textbf{b} \\
+\hline
+foo & bar \\
+\end{tabular}
+\end{center}
+
+`,
+			ext: bf.Tables,
+		},
 	}
 
 	runTest(t, tdt)
 }
 
+func TestTableVAlign(t *testing.T) {
+	renderer := NewRenderer(Opts{Flags: CompletePage})
+	md := bf.New(bf.WithRenderer(renderer), bf.WithExtensions(bf.Tables))
+	ast := md.Parse([]byte("| a | b |\n|---|---|\n| c<br>e | d<br>f |\n"))
+	ast.Walk(func(node *bf.Node, entering bool) bf.WalkStatus {
+		if node.Type == bf.TableCell && node.IsHeader && node.Next != nil {
+			node.TableCellData.Opts = map[string]interface{}{"width": decimal.RequireFromString("0.4"), "valign": "middle"}
+		}
+		return bf.GoToNext
+	})
+	got := string(renderer.RenderBytes(ast))
+	for _, want := range []string{`\usepackage{array}`, `\begin{tabular}{m{0.4\textwidth}l}`, `c\newline e & d f`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%s not found in:\n%s", want, got)
+		}
+	}
+}
+
+func TestTableAutoWidth(t *testing.T) {
+	renderer := NewRenderer(Opts{Flags: CompletePage, TableAutoWidth: true})
+	md := bf.New(bf.WithRenderer(renderer), bf.WithExtensions(bf.Tables))
+	ast := md.Parse([]byte("| a | b |\n|---|---|\n| c | d |\n"))
+	ast.Walk(func(node *bf.Node, entering bool) bf.WalkStatus {
+		if node.Type == bf.TableCell && node.IsHeader && node.Next != nil {
+			node.TableCellData.Opts = map[string]interface{}{"width": decimal.RequireFromString("0.3")}
+		}
+		return bf.GoToNext
+	})
+	got := string(renderer.RenderBytes(ast))
+	for _, want := range []string{`\usepackage{tabularx}`, `\begin{tabularx}{\textwidth}{p{0.3\textwidth}X}`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%s not found in:\n%s", want, got)
+		}
+	}
+}
+
+func TestTableBorderDirective(t *testing.T) {
+	renderer := NewRenderer(Opts{})
+	md := bf.New(bf.WithRenderer(renderer), bf.WithExtensions(bf.Tables))
+	ast := md.Parse([]byte("<!-- table-border outer -->\n\n| a |\n|---|\n| b |\n\n<!-- table-border thick -->\n\n| c |\n|---|\n| d |\n"))
+	got := string(renderer.RenderBytes(ast))
+	if n := strings.Count(got, `\begin{tabular}{|l|}`); n != 2 {
+		t.Errorf("got %d outer tables, want 2, in:\n%s", n, got)
+	}
+	if warnings := renderer.Warnings(); len(warnings) != 1 || !strings.Contains(warnings[0], `unknown preset "thick"`) {
+		t.Errorf("got warnings %q", warnings)
+	}
+
+	// the preset is not written to the AST
+	for node := ast.FirstChild; node != nil; node = node.Next {
+		if node.Type == bf.Table && tableBorderOf(node) != (tableBorder{}) {
+			t.Errorf("table borders set in the AST: %+v", tableBorderOf(node))
+		}
+	}
+}
+
+func TestTableZebraLiteralRenderer(t *testing.T) {
+	// the empty TableZebraColors of a Renderer literal are the default ones
+	renderer := &Renderer{Opts: Opts{TableZebra: true}}
+	ast := bf.New(bf.WithRenderer(renderer), bf.WithExtensions(bf.Tables)).Parse([]byte("| a |\n|---|\n| b |\n"))
+	if got := string(renderer.RenderBytes(ast)); !strings.Contains(got, `\rowcolors{2}{gray!10}{white}`) {
+		t.Errorf("default colors not found in:\n%s", got)
+	}
+}
+
+func TestTableZebraPackage(t *testing.T) {
+	got := render("`code`\n\n| a |\n|---|\n| b |\n", bf.Tables, Opts{TableZebra: true})
+	table, plain := strings.Index(got, `\usepackage[table]{xcolor}`), strings.Index(got, `\usepackage{xcolor}`)
+	if table < 0 || plain < table {
+		t.Errorf("xcolor not loaded with the table option first in:\n%s", got)
+	}
+	if got := render("Text", bf.Tables, Opts{TableZebra: true}); strings.Contains(got, `[table]{xcolor}`) {
+		t.Errorf("xcolor loaded without tables in:\n%s", got)
+	}
+}
+
 func TestTitleblock(t *testing.T) {
 	tdt := []testData{
 		{
@@ -398,6 +1614,49 @@ Normal text`,
 Normal text
 `,
 		},
+		{
+			input: `% Title
+Normal text`,
+			want: `\section*{Title}
+
+Normal text
+`,
+			ext:  bf.Titleblock,
+			opts: Opts{FragmentTitle: FragmentTitleSection},
+		},
+		{
+			input: `% Title
+Normal text`,
+			want: `\textbf{Title}
+
+Normal text
+`,
+			ext:  bf.Titleblock,
+			opts: Opts{FragmentTitle: FragmentTitleBold},
+		},
+		{
+			input: `% Title
+Normal text`,
+			want: `\chapter{Title}
+
+Normal text
+`,
+			ext:   bf.Titleblock,
+			flags: ChapterTitle,
+			opts:  Opts{FragmentTitle: FragmentTitleSection},
+		},
+	}
+
+	runTest(t, tdt)
+}
+
+func TestUnnumberedSections(t *testing.T) {
+	opts := Opts{UnnumberedSections: true}
+	tdt := []testData{
+		{input: `## foo`, want: "\\section*{foo}\n\\addcontentsline{toc}{section}{foo}\n", opts: opts},
+		{input: `#### foo`, want: "\\subsubsection*{foo}\n\\addcontentsline{toc}{subsubsection}{foo} ", opts: opts},
+		{input: `## foo *bar* baz`, want: "\\section*{foo \\emph{bar} baz}\n\\addcontentsline{toc}{section}{foo \\emph{bar} baz}\n", opts: opts},
+		{input: `## 100% a_b`, want: "\\section*{100\\% a\\_b}\n\\addcontentsline{toc}{section}{100\\% a\\_b}\n", opts: opts},
 	}
 
 	runTest(t, tdt)
@@ -437,6 +1696,135 @@ func BenchmarkRender(b *testing.B) {
 
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
-		renderer.Render(ast)
+		renderer.RenderBytes(ast)
+	}
+}
+
+func BenchmarkRenderFootnotes(b *testing.B) {
+	var doc strings.Builder
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&doc, "Paragraph %d with a note[^n%d].\n\n", i, i)
+	}
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&doc, "[^n%d]: Note _%d_.\n", i, i)
+	}
+
+	renderer := NewRenderer(Opts{})
+	md := bf.New(bf.WithExtensions(bf.CommonExtensions|bf.Footnotes), bf.WithRenderer(renderer))
+	ast := md.Parse([]byte(doc.String()))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		renderer.Render(io.Discard, ast)
+	}
+}
+
+// escapeRunes is the former []rune based implementation of Escape, kept as a
+// reference for TestEscapeBytes and BenchmarkEscape.
+func escapeRunes(r *Renderer, w io.Writer, t []byte) {
+	text := []rune(string(t))
+	for i := 0; i < len(text); i++ {
+		org := i
+
+		for i < len(text) && latexEscaper[text[i]] == nil {
+			i++
+		}
+
+		if i > org {
+			w.Write([]byte(string(text[org:i])))
+			if i >= len(text) {
+				break
+			}
+		}
+
+		switch text[i] {
+		case '\'':
+			if r.quoted {
+				if r.quoteOpen {
+					switch text[i+1] {
+					case '\r', '\n', ' ', '\t', '.':
+						WriteRune(w, '’')
+					}
+				} else {
+					WriteRune(w, '‘')
+				}
+				r.quoted = false
+				r.quoteOpen = false
+			} else {
+				if i > 0 {
+					switch text[i-1] {
+					case '\r', '\n', ' ', '\t', '.':
+						WriteRune(w, '‘')
+						r.quoted = true
+						r.quoteOpen = true
+					default:
+						WriteRune(w, '’')
+					}
+				} else {
+					WriteRune(w, '‘')
+					r.quoted = true
+					r.quoteOpen = true
+				}
+			}
+		default:
+			w.Write(latexEscaper[text[i]])
+		}
+	}
+}
+
+func TestEscapeBytes(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"plain text",
+		`abcd#$%~_{}&\`,
+		"ação & reação: 50% {ok}",
+		"it's 'quoted' here. 'a' b",
+		"über ' naïve 'x' ß_",
+	} {
+		var got, want strings.Builder
+		NewRenderer(Opts{}).Escape(&got, []byte(s))
+		escapeRunes(NewRenderer(Opts{}), &want, []byte(s))
+		if got.String() != want.String() {
+			t.Errorf("%q: got %q, want %q", s, got.String(), want.String())
+		}
+	}
+}
+
+func BenchmarkEscape(b *testing.B) {
+	text := []byte(strings.Repeat("Some plain paragraph text with few special characters, ação & 10% off. ", 20))
+	renderer := NewRenderer(Opts{})
+
+	b.Run("runes", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			escapeRunes(renderer, io.Discard, text)
+		}
+	})
+	b.Run("bytes", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			renderer.Escape(io.Discard, text)
+		}
+	})
+}
+
+func TestEmailCommand(t *testing.T) {
+	got := render("<doe@example.com>", bf.Autolink, Opts{EmailCommand: "email"})
+	if !strings.Contains(got, `\providecommand{\email}[1]{\texttt{#1}}`) {
+		t.Errorf("\\email not provided in:\n%s", got)
+	}
+	got = render("<doe@example.com>", bf.Autolink, Opts{EmailCommand: "texttt"})
+	if strings.Contains(got, `\providecommand{\texttt}`) || !strings.Contains(got, `{\texttt{doe@example.com}}`) {
+		t.Errorf("\\texttt provided or not used in:\n%s", got)
+	}
+}
+
+func TestBreakURLs(t *testing.T) {
+	if got := render("Text", 0, Opts{BreakURLs: true}); !strings.Contains(got, `\usepackage{xurl}`) {
+		t.Errorf("xurl not loaded in:\n%s", got)
+	}
+	if got := render("Text", 0, Opts{}); strings.Contains(got, `\usepackage{xurl}`) {
+		t.Errorf("xurl loaded in:\n%s", got)
 	}
 }
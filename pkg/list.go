@@ -0,0 +1,107 @@
+package pkg
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+
+	bf "github.com/russross/blackfriday/v2"
+)
+
+// enumCounters are the LaTeX counters of the nested enumerate levels.
+var enumCounters = []string{"enumi", "enumii", "enumiii", "enumiv"}
+
+// listStarts returns the start numbers of the ordered lists of ast, in
+// document order. The parser drops them, so each one is read from the item
+// marker of the source line of the first text of the list, searched after the
+// previous list. The lists not found, like the ones of included files, start
+// at 1.
+func listStarts(ast *bf.Node, source []byte) (starts []int) {
+	pos := 0
+	ast.Walk(func(node *bf.Node, entering bool) bf.WalkStatus {
+		if !entering || !isOrderedList(node) {
+			return bf.GoToNext
+		}
+		n := 1
+		if text := firstText(node); len(text) > 0 {
+			if m, end := findListStart(source[pos:], text); end >= 0 {
+				n, pos = m, pos+end
+			}
+		}
+		starts = append(starts, n)
+		return bf.GoToNext
+	})
+	return
+}
+
+// firstText returns the first line of the first text of node.
+func firstText(node *bf.Node) (text []byte) {
+	node.Walk(func(node *bf.Node, entering bool) bf.WalkStatus {
+		if node.Type == bf.Text && len(node.Literal) > 0 {
+			text = node.Literal
+			if i := bytes.IndexByte(text, '\n'); i >= 0 {
+				text = text[:i]
+			}
+			return bf.Terminate
+		}
+		return bf.GoToNext
+	})
+	return
+}
+
+// findListStart returns the number of the ordered list item of source with
+// text, like `5. foo` or `> 5. **foo**`, and the end of text. The end is -1 if
+// not found.
+func findListStart(source, text []byte) (n, end int) {
+	for off := 0; ; {
+		i := bytes.Index(source[off:], text)
+		if i < 0 {
+			return 0, -1
+		}
+		i += off
+		line := source[bytes.LastIndexByte(source[:i], '\n')+1 : i]
+		if n, rest, ok := orderedItem(strings.TrimLeft(string(line), " \t>")); ok && strings.Trim(rest, " \t*_~`[<!") == "" {
+			return n, i + len(text)
+		}
+		off = i + 1
+	}
+}
+
+// orderedItem parses the ordered list item line, like `5. foo`, with its
+// indentation trimmed, into its number and content.
+func orderedItem(line string) (n int, rest string, ok bool) {
+	i := 0
+	for i < len(line) && i < 9 && line[i] >= '0' && line[i] <= '9' {
+		n = n*10 + int(line[i]-'0')
+		i++
+	}
+	if i == 0 || i+1 >= len(line) || line[i] != '.' || line[i+1] != ' ' && line[i+1] != '\t' {
+		return
+	}
+	return n, line[i+1:], true
+}
+
+func isOrderedList(node *bf.Node) bool {
+	return node.Type == bf.List && !node.IsFootnotesList &&
+		node.ListFlags&bf.ListTypeOrdered != 0 && node.ListFlags&bf.ListTypeDefinition == 0
+}
+
+// renderListStart sets the counter of the ordered list to its start number,
+// if it doesn't start at 1.
+func (r *Renderer) renderListStart(w io.Writer, node *bf.Node) {
+	i := r.orderedLists
+	r.orderedLists++
+	if i >= len(r.starts) || r.starts[i] == 1 {
+		return
+	}
+	depth := 0
+	for p := node; p != nil; p = p.Parent {
+		if isOrderedList(p) {
+			depth++
+		}
+	}
+	if depth <= len(enumCounters) {
+		WriteString(w, `\setcounter{`+enumCounters[depth-1]+`}{`+strconv.Itoa(r.starts[i]-1)+"}\n")
+	}
+}
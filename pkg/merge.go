@@ -0,0 +1,54 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// MergePDFMaster returns the master LaTeX document that includes every page
+// of the pdfs, in order, with pdfpages.
+func MergePDFMaster(pdfs []string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`\documentclass{article}
+\usepackage{pdfpages}
+
+\begin{document}
+`)
+	for _, pdf := range pdfs {
+		buf.WriteString(`\includepdf[pages=-]{` + filepath.ToSlash(pdf) + "}\n")
+	}
+	buf.WriteString(`\end{document}` + "\n")
+	return buf.Bytes()
+}
+
+// MergePDF compiles the texs with the LaTeX engine, see CompilePDF, and
+// merges their PDFs into the PDF file out, compiled from the master file next
+// to it. The texs must be complete documents, see CompletePage. With
+// noClobber, it fails if the master file exists.
+func MergePDF(out, engine string, texs []string, noClobber bool) (err error) {
+	if filepath.Ext(out) != ".pdf" {
+		return fmt.Errorf("merge pdf: %q: the extension must be .pdf", out)
+	}
+	var pdfs []string
+	for _, tex := range texs {
+		var pdf string
+		if pdf, err = filepath.Abs(strings.TrimSuffix(tex, filepath.Ext(tex)) + ".pdf"); err != nil {
+			return
+		}
+		pdfs = append(pdfs, pdf)
+	}
+
+	master := strings.TrimSuffix(out, ".pdf") + ".tex"
+	dir := filepath.Dir(master)
+	if err = writeFile(&PathFS{RootDir: dir, FS: DirFS(dir)}, filepath.Base(master), MergePDFMaster(pdfs), noClobber); err != nil {
+		return
+	}
+	for _, tex := range texs {
+		if err = CompilePDF(tex, engine); err != nil {
+			return
+		}
+	}
+	return CompilePDF(master, engine)
+}
@@ -0,0 +1,64 @@
+package pkg
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMergePDFMaster(t *testing.T) {
+	got := string(MergePDFMaster([]string{"a/doc.pdf", "b/doc.pdf"}))
+	a, b := strings.Index(got, `\includepdf[pages=-]{a/doc.pdf}`), strings.Index(got, `\includepdf[pages=-]{b/doc.pdf}`)
+	if !strings.Contains(got, `\usepackage{pdfpages}`) || a < 0 || b < a {
+		t.Errorf("PDFs not included in order:\n%s", got)
+	}
+}
+
+func TestMergePDF(t *testing.T) {
+	if _, err := exec.LookPath("pdflatex"); err != nil {
+		t.Skip("pdflatex not found")
+	}
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a/doc.md": "# A\n\nText.\n", "b/doc.md": "# B\n\nText.\n"})
+
+	var texs []string
+	for _, sub := range []string{"a", "b"} {
+		cfg := newRunConfig(filepath.Join(dir, sub), "doc.md", "doc.tex")
+		cfg.Opts.Flags |= CompletePage
+		if err := Exec(cfg); err != nil {
+			t.Fatal(err)
+		}
+		texs = append(texs, filepath.Join(dir, sub, "doc.tex"))
+	}
+
+	out := filepath.Join(dir, "merged.pdf")
+	if err := MergePDF(out, "", texs, false); err != nil {
+		t.Fatal(err)
+	}
+	master := readFile(t, filepath.Join(dir, "merged.tex"))
+	for _, name := range []string{"a/doc.pdf", "b/doc.pdf"} {
+		if !strings.Contains(master, filepath.ToSlash(filepath.Join(dir, name))+"}") {
+			t.Errorf("%s not included in:\n%s", name, master)
+		}
+	}
+	if _, err := os.Stat(out); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMergePDFNoClobber(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"merged.tex": "original"})
+
+	err := MergePDF(filepath.Join(dir, "merged.pdf"), "", []string{filepath.Join(dir, "doc.tex")}, true)
+	if !errors.Is(err, os.ErrExist) {
+		t.Errorf("got error %v, want os.ErrExist", err)
+	}
+	if got := readFile(t, filepath.Join(dir, "merged.tex")); got != "original" {
+		t.Errorf("got %q, want the original master", got)
+	}
+}
@@ -0,0 +1,57 @@
+package pkg
+
+import (
+	"bytes"
+	"io"
+)
+
+// DefaultPassthroughLanguages are the default Opts.PassthroughLanguages.
+var DefaultPassthroughLanguages = []string{"tikz", "pgfplots", "asy"}
+
+// passthroughEnvs are the environments wrapping the code of the passthrough
+// languages, unless the code opens it itself.
+var passthroughEnvs = map[string]string{
+	"tikz":     "tikzpicture",
+	"pgfplots": "tikzpicture",
+	"asy":      "asy",
+}
+
+// passthroughPackages are the packages drawing the passthrough languages.
+var passthroughPackages = map[string]string{
+	"tikz":     "tikz",
+	"pgfplots": "pgfplots",
+	"asy":      "asymptote",
+}
+
+func (r *Renderer) passthroughLanguages() []string {
+	if r.PassthroughLanguages == nil {
+		return DefaultPassthroughLanguages
+	}
+	return r.PassthroughLanguages
+}
+
+func (r *Renderer) isPassthrough(lang []byte) bool {
+	for _, l := range r.passthroughLanguages() {
+		if l == string(lang) {
+			return true
+		}
+	}
+	return false
+}
+
+// renderPassthrough writes the code of the passthrough language lang
+// literally, wrapped in its environment.
+func renderPassthrough(w io.Writer, lang string, code []byte) {
+	env := passthroughEnvs[lang]
+	if env != "" && bytes.Contains(code, []byte(`\begin{`+env+`}`)) {
+		env = ""
+	}
+	if env != "" {
+		WriteString(w, `\begin{`+env+"}\n")
+	}
+	w.Write(code)
+	if env != "" {
+		WriteString(w, `\end{`+env+"}\n")
+	}
+	WriteByte(w, '\n')
+}
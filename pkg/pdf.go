@@ -0,0 +1,66 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// latexmkEngines maps the LaTeX engines to their latexmk options.
+var latexmkEngines = map[string]string{
+	"pdflatex": "-pdf",
+	"xelatex":  "-pdfxe",
+	"lualatex": "-pdflua",
+}
+
+// CompilePDF compiles the tex file to PDF, next to it, with the LaTeX engine
+// (pdflatex, xelatex or lualatex; defaults to pdflatex). It uses latexmk when
+// available, or else runs the engine twice, so that the table of contents and
+// the references resolve. On failure, the error ends with the tail of the
+// LaTeX log.
+func CompilePDF(tex, engine string) (err error) {
+	if engine == "" {
+		engine = "pdflatex"
+	}
+	opt, ok := latexmkEngines[engine]
+	if !ok {
+		return fmt.Errorf("unknown LaTeX engine %q", engine)
+	}
+
+	var (
+		dir, base = filepath.Split(tex)
+		runs      [][]string
+	)
+	if _, err := exec.LookPath("latexmk"); err == nil {
+		runs = [][]string{{"latexmk", opt, "-interaction=nonstopmode", "-halt-on-error", base}}
+	} else {
+		run := []string{engine, "-interaction=nonstopmode", "-halt-on-error", base}
+		runs = [][]string{run, run}
+	}
+
+	for _, run := range runs {
+		cmd := exec.Command(run[0], run[1:]...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			log, _ := os.ReadFile(strings.TrimSuffix(tex, filepath.Ext(tex)) + ".log")
+			if len(log) == 0 {
+				log = out
+			}
+			return fmt.Errorf("%s %s: %s\n%s", run[0], tex, err, logTail(log, 20))
+		}
+	}
+	return nil
+}
+
+// logTail returns the last n lines of log.
+func logTail(log []byte, n int) []byte {
+	log = bytes.TrimRight(log, "\n")
+	pos := len(log)
+	for ; n > 0 && pos >= 0; n-- {
+		pos = bytes.LastIndexByte(log[:pos], '\n')
+	}
+	return log[pos+1:]
+}
@@ -0,0 +1,70 @@
+package pkg
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogTail(t *testing.T) {
+	for _, v := range []struct {
+		log  string
+		n    int
+		want string
+	}{
+		{"a\nb\nc\n", 2, "b\nc"},
+		{"a\nb\nc", 5, "a\nb\nc"},
+		{"", 3, ""},
+	} {
+		if got := string(logTail([]byte(v.log), v.n)); got != v.want {
+			t.Errorf("%q, %d: got %q, want %q", v.log, v.n, got, v.want)
+		}
+	}
+}
+
+func TestCompilePDF(t *testing.T) {
+	if err := CompilePDF("doc.tex", "troff"); err == nil || !strings.Contains(err.Error(), "troff") {
+		t.Errorf("got error %v, want an unknown engine error", err)
+	}
+	if _, err := exec.LookPath("pdflatex"); err != nil {
+		t.Skip("pdflatex not found")
+	}
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"doc.tex": "\\documentclass{article}\n\\begin{document}\nText\n\\end{document}\n",
+		"bad.tex": "\\documentclass{article}\n\\begin{document}\n\\undefinedcommand\n\\end{document}\n",
+	})
+	if err := CompilePDF(filepath.Join(dir, "doc.tex"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "doc.pdf")); err != nil {
+		t.Error(err)
+	}
+	if err := CompilePDF(filepath.Join(dir, "bad.tex"), ""); err == nil || !strings.Contains(err.Error(), "Undefined control sequence") {
+		t.Errorf("got error %v, want the log tail", err)
+	}
+}
+
+func TestExecCompilePDF(t *testing.T) {
+	if _, err := exec.LookPath("pdflatex"); err != nil {
+		t.Skip("pdflatex not found")
+	}
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"doc.md": "# Title\n\nSome *text*.\n"})
+
+	cfg := newRunConfig(dir, "doc.md", "doc.tex")
+	cfg.Opts.Flags |= CompletePage
+	if err := Exec(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := CompilePDF(filepath.Join(dir, "doc.tex"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "doc.pdf")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,113 @@
+package pkg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	bf "github.com/russross/blackfriday/v2"
+)
+
+// SetOption sets the renderer option key to value from then on, as the
+// `<!-- ::set key=value -->` pragmas do. The keys are the config names of the
+// options that apply to the document body, and `toc`, the TOC flag. The
+// headerOptions pragmas apply to the header too: see applyHeaderPragmas.
+func (r *Renderer) SetOption(key, value string) (err error) {
+	switch key {
+	case "toc":
+		var toc bool
+		if toc, err = strconv.ParseBool(value); err == nil {
+			if r.Flags &^= TOC; toc {
+				r.Flags |= TOC
+			}
+		}
+	case "quotation":
+		r.EnvQuotation = value
+	case "trim_code_blank_lines":
+		r.TrimCodeBlankLines, err = strconv.ParseBool(value)
+	case "shorten_autolinks":
+		r.ShortenAutolinks, err = strconv.ParseBool(value)
+	case "unnumbered_sections":
+		r.UnnumberedSections, err = strconv.ParseBool(value)
+	case "definition_list_as_table":
+		r.DefinitionListAsTable, err = strconv.ParseBool(value)
+	case "dollar_math":
+		r.DollarMath, err = strconv.ParseBool(value)
+	case "color_spans":
+		r.EnableColorSpans, err = strconv.ParseBool(value)
+	case "email_command":
+		r.EmailCommand = value
+	case "hardbreak_command":
+		r.HardbreakCommand = value
+	case "highlight":
+		r.Highlight, err = strconv.ParseBool(value)
+	case "highlight_color":
+		r.HighlightColor = value
+	case "hrule_as_newpage":
+		r.HRuleAsNewPage, err = strconv.ParseBool(value)
+	case "horizontal_rule_command":
+		r.HorizontalRuleCommand = value
+	case "table_border":
+		if _, ok := tableBorderPresets[value]; ok || value == "" {
+			r.TableBorderPreset = value
+		} else {
+			err = fmt.Errorf("unknown preset %q", value)
+		}
+	case "relative_links_as_text":
+		r.RelativeLinksAsText, err = strconv.ParseBool(value)
+	case "language_quotes":
+		r.LanguageQuotes, err = strconv.ParseBool(value)
+	case "heading_offset":
+		r.HeadingOffset, err = strconv.Atoi(value)
+	default:
+		return fmt.Errorf("unknown option %q", key)
+	}
+	if err != nil {
+		return fmt.Errorf("option %s: %s", key, err)
+	}
+	return
+}
+
+// headerOptions are the SetOption keys of the options read by the header,
+// before the body pragmas are reached, like the ones of its packages and
+// commands.
+var headerOptions = map[string]bool{
+	"toc":             true,
+	"email_command":   true,
+	"color_spans":     true,
+	"highlight":       true,
+	"highlight_color": true,
+}
+
+// applyHeaderPragmas applies the header options of the `<!-- ::set ... -->`
+// pragmas of ast, wherever they are, before it is rendered. Their errors are
+// left to the rendering of the pragmas.
+func (r *Renderer) applyHeaderPragmas(ast *bf.Node) {
+	ast.Walk(func(node *bf.Node, entering bool) bf.WalkStatus {
+		if node.Type != bf.HTMLBlock {
+			return bf.GoToNext
+		}
+		if name, args, ok := parseDirective(node.Literal); ok && name == "::set" {
+			for _, arg := range strings.Fields(args) {
+				if pos := strings.IndexByte(arg, '='); pos > 0 && headerOptions[arg[:pos]] {
+					r.SetOption(arg[:pos], arg[pos+1:])
+				}
+			}
+		}
+		return bf.GoToNext
+	})
+}
+
+// setPragma applies the `key=value` pairs of a `<!-- ::set ... -->` pragma.
+func (r *Renderer) setPragma(args string) error {
+	for _, arg := range strings.Fields(args) {
+		pos := strings.IndexByte(arg, '=')
+		if pos <= 0 {
+			return fmt.Errorf("invalid pragma %q, want key=value", arg)
+		}
+		if err := r.SetOption(arg[:pos], arg[pos+1:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
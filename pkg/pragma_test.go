@@ -0,0 +1,18 @@
+package pkg
+
+import "testing"
+
+func TestSetPragma(t *testing.T) {
+	r := NewRenderer(Opts{})
+	if err := r.setPragma("heading_offset=1 quotation=quote"); err != nil {
+		t.Fatal(err)
+	}
+	if r.HeadingOffset != 1 || r.EnvQuotation != "quote" {
+		t.Errorf("options not set: %+v", r.Opts)
+	}
+	for _, args := range []string{"toc", "unknown=1", "shorten_autolinks=maybe"} {
+		if err := r.setPragma(args); err == nil {
+			t.Errorf("%q: no error", args)
+		}
+	}
+}
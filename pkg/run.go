@@ -2,12 +2,14 @@ package pkg
 
 import (
 	"archive/tar"
-	"bytes"
+	"archive/zip"
+	"compress/gzip"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path"
+	"path/filepath"
 	"sort"
 	"strings"
 	"time"
@@ -29,9 +31,63 @@ type RunConfig struct {
 	JoinedOutput  string
 	LatexRawFiles map[string]*LatexRaw
 	Opts          Opts
+
+	// OutputDir, when set, is the directory of the generated files instead of
+	// the RootDir. Sources are still read from the RootDir.
+	OutputDir string
+
+	// NoClobber makes Exec fail instead of overwriting existing output files.
+	NoClobber bool
+
+	// IncludePrefix replaces the `:: ` prefix of the include lines, for the
+	// documents having lines starting with it. The code includes follow it,
+	// e.g. `@includecode` for `@include `.
+	IncludePrefix string
+
+	// ExpandEnv expands the environment variables in the include paths. The
+	// command line tool expands the SRC, DST and work dir values too.
+	ExpandEnv bool
+
+	// Vars replaces the `{{name}}` tokens of the input by their values before
+	// rendering, out of the fenced code blocks and the code spans. Unknown
+	// tokens are kept and `\{{name}}` renders a literal `{{name}}`.
+	Vars map[string]string
+
+	// IgnoreMissingIncludes renders the missing included files as
+	// `% MISSING INCLUDE: path` comments instead of failing.
+	IgnoreMissingIncludes bool
+
+	// TarFileMode is the mode of the files of the tar outputs. Defaults to
+	// 0666. With it and a zero Now, the modification time of the archived
+	// files is ArchiveEpoch, so that the same sources yield byte-identical
+	// archives.
+	TarFileMode int64
+
+	// Check renders the document without writing any file and fails with its
+	// issues: missing images, empty or broken links and raw HTML blocks.
+	Check bool
+
+	// LogWriter receives the progress log. Defaults to os.Stderr.
+	LogWriter io.Writer
+
+	// Verbosity of the progress log: LogQuiet discards it but the warnings,
+	// and LogVerbose adds the written files to it.
+	Verbosity int
+
+	// DryRun renders the document without writing any file, listing the
+	// files, or archive entries, that would be written and their sizes to the
+	// LogWriter instead, whatever the Verbosity.
+	DryRun bool
 	PathFS
 }
 
+// The RunConfig.Verbosity levels.
+const (
+	LogQuiet   = -1
+	LogNormal  = 0
+	LogVerbose = 1
+)
+
 type DevNull struct {
 }
 
@@ -43,16 +99,68 @@ func (DevNull) Close() error {
 	return nil
 }
 
+// ArchiveEpoch is the earliest modification time of the archived files, and
+// the one of the reproducible archives: the zip format can't store earlier
+// dates.
+var ArchiveEpoch = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
 func Exec(cfg RunConfig) (err error) {
 	var (
-		input bytes.Buffer
+		input = getBuffer()
+
+		// the modification time of the archived files
+		modTime = cfg.Now
+
+		// the progress log
+		logw = cfg.LogWriter
+
+		// the dry run listing
+		listw io.Writer
+
+		// the warnings, logged whatever the Verbosity
+		warnw io.Writer
+
+		tarFileMode = cfg.TarFileMode
+
+		tarDirs = map[string]bool{}
+
+		addDirToTarWriter = func(dir string, tarWriter *tar.Writer) (err error) {
+			if dir == "." || dir == "/" {
+				return nil
+			}
+			var name string
+			for _, part := range strings.Split(dir, "/") {
+				if name += part + "/"; tarDirs[name] || part == "" {
+					continue
+				}
+				tarDirs[name] = true
+				header := &tar.Header{
+					Typeflag: tar.TypeDir,
+					Name:     name,
+					Mode:     0775,
+					ModTime:  modTime,
+				}
+				if err = tarWriter.WriteHeader(header); err != nil {
+					return errors.New(fmt.Sprintf("Could not write header for directory '%s', got error '%s'", name, err.Error()))
+				}
+			}
+			return nil
+		}
 
 		addFileToTarWriter = func(filePath string, data []byte, tarWriter *tar.Writer) (err error) {
+			filePath = tarEntryName(filePath)
+			if cfg.Verbosity >= LogVerbose {
+				fmt.Fprintln(logw, "add", filePath)
+			}
+			if err = addDirToTarWriter(path.Dir(filePath), tarWriter); err != nil {
+				return
+			}
+
 			header := &tar.Header{
 				Name:    filePath,
 				Size:    int64(len(data)),
-				Mode:    0666,
-				ModTime: cfg.Now,
+				Mode:    tarFileMode,
+				ModTime: modTime,
 			}
 
 			err = tarWriter.WriteHeader(header)
@@ -68,17 +176,52 @@ func Exec(cfg RunConfig) (err error) {
 			return nil
 		}
 
+		addFileToZipWriter = func(filePath string, data []byte, zipWriter *zip.Writer) (err error) {
+			filePath = tarEntryName(filePath)
+			if cfg.Verbosity >= LogVerbose {
+				fmt.Fprintln(logw, "add", filePath)
+			}
+			var w io.Writer
+			if w, err = zipWriter.CreateHeader(&zip.FileHeader{
+				Name:     filePath,
+				Method:   zip.Deflate,
+				Modified: modTime,
+			}); err != nil {
+				return fmt.Errorf("Could not write header for file '%s', got error '%s'", filePath, err.Error())
+			}
+			if _, err = w.Write(data); err != nil {
+				return fmt.Errorf("Could not copy the file '%s' data to the zip, got error '%s'", filePath, err.Error())
+			}
+			return nil
+		}
+
 		createFile = func(pth string, data []byte) (err error) {
-			var f io.WriteCloser
-			if f, err = cfg.PathFS.CreateAll(pth); err != nil {
+			out := cfg.PathFS
+			if cfg.OutputDir != "" {
+				out.RootDir = cfg.OutputDir
+				out.FS = DirFS(cfg.OutputDir)
+			}
+			if cfg.DryRun {
+				if cfg.NoClobber && out.exists(pth) {
+					return &os.PathError{Op: "create", Path: pth, Err: os.ErrExist}
+				}
+				fmt.Fprintf(listw, "%s (%d bytes)\n", path.Join(out.RootDir, out.pathOf(pth)), len(data))
 				return
 			}
-			defer f.Close()
-			_, err = f.Write(data)
-			return
+			if cfg.Verbosity >= LogVerbose {
+				fmt.Fprintln(logw, "write", path.Join(out.RootDir, out.pathOf(pth)))
+			}
+			return writeFile(&out, pth, data, cfg.NoClobber)
 		}
 	)
 
+	if modTime.Before(ArchiveEpoch) {
+		modTime = ArchiveEpoch
+	}
+	if tarFileMode == 0 {
+		tarFileMode = 0666
+	}
+
 	if cfg.LatexRawFiles == nil {
 		cfg.LatexRawFiles = map[string]*LatexRaw{}
 	}
@@ -87,6 +230,25 @@ func Exec(cfg RunConfig) (err error) {
 		cfg.RootDir = "."
 	}
 
+	if cfg.IncludePrefix != "" {
+		cfg.PathFS.IncludePrefix = cfg.IncludePrefix
+	}
+	if cfg.ExpandEnv {
+		cfg.PathFS.ExpandEnv = true
+	}
+	if cfg.IgnoreMissingIncludes {
+		cfg.PathFS.IgnoreMissingIncludes = true
+	}
+	if logw == nil {
+		logw = stderr
+	}
+	listw, warnw = logw, logw
+	if cfg.Verbosity <= LogQuiet {
+		logw = io.Discard
+	}
+	cfg.PathFS.LogWriter = logw
+	cfg.PathFS.WarningWriter = warnw
+
 	if cfg.JoinedOutput != "" {
 		if cfg.Input == "-" {
 			cfg.JoinedOutput = ""
@@ -95,15 +257,34 @@ func Exec(cfg RunConfig) (err error) {
 		}
 	}
 
-	fmt.Fprintln(os.Stderr, "======>> begin", cfg.Input, "<<======")
-	fmt.Fprintln(os.Stderr, "root dir: ", cfg.RootDir)
-	fmt.Fprintln(os.Stderr, "joined output: ", cfg.JoinedOutput)
-	defer fmt.Fprintln(os.Stderr, "======>> end", cfg.Input, "<<======")
+	fmt.Fprintln(logw, "======>> begin", cfg.Input, "<<======")
+	fmt.Fprintln(logw, "root dir: ", cfg.RootDir)
+	fmt.Fprintln(logw, "joined output: ", cfg.JoinedOutput)
+	if cfg.OutputDir != "" {
+		fmt.Fprintln(logw, "output dir: ", cfg.OutputDir)
+	}
+	defer fmt.Fprintln(logw, "======>> end", cfg.Input, "<<======")
+
+	defer putBuffer(input)
 
-	if err = cfg.PathFS.ReadFile(&input, cfg.Input); err != nil {
+	if err = cfg.PathFS.ReadFile(input, cfg.Input); err != nil {
 		return
 	}
 
+	data := input.Bytes()
+	if len(cfg.Vars) > 0 {
+		data = substituteMarkdownVars(data, cfg.Vars)
+	}
+
+	fm, body, err := ParseFrontMatter(data)
+	if err != nil {
+		return fmt.Errorf("%s: frontmatter: %s", cfg.Input, err)
+	}
+	fm.Apply(&cfg.Opts)
+	if cfg.Opts.Now.IsZero() {
+		cfg.Opts.Now = cfg.Now
+	}
+
 	cfg.Opts.HtmlBlockHandler = func(r *Renderer, w io.Writer, node *bf.Node, entering bool) bf.WalkStatus {
 		switch node.Type {
 		case bf.HTMLSpan:
@@ -111,6 +292,13 @@ func Exec(cfg RunConfig) (err error) {
 		case bf.HTMLBlock:
 			p := unsafe.Pointer(&node.Literal)
 			s := *(*string)(p)
+			if name, arg, ok := parseDirective(node.Literal); ok && name == "::set" {
+				// rendering pragma: <!-- ::set key=value -->
+				if err := r.setPragma(arg); err != nil {
+					fmt.Fprintln(warnw, "warning:", cfg.Input+":", err)
+				}
+				return bf.GoToNext
+			}
 			if strings.HasPrefix(s, "<!-- ::") {
 				if pos := strings.Index(s, "\n"); pos > 0 {
 					key := s[7:pos]
@@ -130,7 +318,11 @@ func Exec(cfg RunConfig) (err error) {
 	}
 
 	extensions := bf.CommonExtensions | bf.Footnotes | bf.DefinitionLists
+	if err = cfg.Opts.Validate(); err != nil {
+		return fmt.Errorf("%s: %s", cfg.Input, err)
+	}
 	renderer := NewRenderer(cfg.Opts)
+	renderer.rawBlocksOnly = true
 
 	md := bf.New(
 		bf.WithFileName(cfg.Input),
@@ -139,17 +331,40 @@ func Exec(cfg RunConfig) (err error) {
 		bf.WithExtensions(extensions),
 	)
 
-	ast := md.Parse(input.Bytes())
+	ast := md.Parse(body)
+	renderer.source = body
+	renderer.applyHeaderPragmas(ast)
 
-	var (
-		result bytes.Buffer
-		w      io.Writer = &result
-	)
-	if cfg.Output == "-" {
-		w = os.Stdout
+	logWarnings := func() {
+		for _, warning := range renderer.Warnings() {
+			fmt.Fprintln(warnw, "warning:", cfg.Input+":", warning)
+		}
 	}
 
-	renderer.Render(w, ast)
+	if cfg.Check {
+		issues := checkDocument(ast, &cfg.PathFS)
+		if err = renderer.RenderStream(io.Discard, ast); err != nil {
+			return
+		}
+		logWarnings()
+		if len(issues) > 0 {
+			return fmt.Errorf("%s: %d issue(s):\n\t%s", cfg.Input, len(issues), strings.Join(issues, "\n\t"))
+		}
+		return
+	}
+
+	var result []byte
+	if cfg.Output == "-" && !cfg.DryRun {
+		if err = renderer.RenderStream(os.Stdout, ast); err != nil {
+			return
+		}
+	} else {
+		buf := getBuffer()
+		defer putBuffer(buf)
+		renderer.Render(buf, ast)
+		result = buf.Bytes()
+	}
+	logWarnings()
 
 	var configNames []*LatexRaw
 
@@ -162,55 +377,97 @@ func Exec(cfg RunConfig) (err error) {
 
 	switch cfg.Output {
 	case "-":
+		if cfg.DryRun {
+			fmt.Fprintf(listw, "- (%d bytes)\n", len(result))
+		}
 	default:
-		if n := cfg.Output; strings.HasPrefix(n, "tar:") {
-			n = n[4:]
-			var main string
-			var f io.Writer
-			parts := strings.Split(n, ":")
-			switch parts[0] {
-			case "-":
+		if kind, n := archiveKind(cfg.Output); kind != "" {
+			var (
+				main string
+				f    io.Writer
+				// closed in reverse order, the archive writers before the
+				// file, returning the first error
+				closers []io.Closer
+			)
+			defer func() {
+				for i := len(closers) - 1; i >= 0; i-- {
+					if file, ok := closers[i].(*atomicFile); ok && err != nil {
+						// keeps the previous archive
+						file.Abort()
+					} else if cerr := closers[i].Close(); err == nil {
+						err = cerr
+					}
+				}
+			}()
+			if n, main, err = parseArchiveDst(n); err != nil {
+				return
+			}
+			if main == "" {
+				if cfg.Input == "-" {
+					main = "stdin.tex"
+				} else {
+					main = cfg.Input[0:len(cfg.Input)-2] + "tex"
+				}
+			}
+			switch {
+			case cfg.DryRun:
+				f = DevNull{}
+			case n == "-":
 				f = os.Stdout
+			case n == "/dev/null":
+				f = DevNull{}
 			default:
-				n = parts[0]
-				switch n {
-				case "/dev/null":
-					f = DevNull{}
-				default:
-					var f2 *os.File
-					if f2, err = os.Create(n); err != nil {
-						return
-					}
-					f = f2
-					defer f2.Close()
+				var f2 *atomicFile
+				if cfg.OutputDir != "" && !filepath.IsAbs(n) {
+					n = filepath.Join(cfg.OutputDir, n)
+				}
+				if f2, err = createAtomic(n, cfg.NoClobber); err != nil {
+					return
 				}
+				f = f2
+				closers = append(closers, f2)
 			}
-			switch len(parts) {
-			case 1:
-			case 2:
-				main = parts[1]
+
+			var addFile func(filePath string, data []byte) error
+			switch kind {
+			case "zip":
+				zipWriter := zip.NewWriter(f)
+				closers = append(closers, zipWriter)
+				addFile = func(filePath string, data []byte) error {
+					return addFileToZipWriter(filePath, data, zipWriter)
+				}
 			default:
-				return fmt.Errorf("invalid DST value")
+				if kind != "tar" {
+					gzipWriter := gzip.NewWriter(f)
+					closers = append(closers, gzipWriter)
+					f = gzipWriter
+				}
+				tarWriter := tar.NewWriter(f)
+				closers = append(closers, tarWriter)
+				addFile = func(filePath string, data []byte) error {
+					return addFileToTarWriter(filePath, data, tarWriter)
+				}
 			}
-			if main == "" {
-				main = cfg.Input[0:len(cfg.Input)-2] + "tex"
+			if cfg.DryRun {
+				add := addFile
+				addFile = func(filePath string, data []byte) error {
+					fmt.Fprintf(listw, "%s:%s (%d bytes)\n", n, tarEntryName(filePath), len(data))
+					return add(filePath, data)
+				}
 			}
 
-			tarWriter := tar.NewWriter(f)
-			defer tarWriter.Close()
-
 			if cfg.JoinedOutput != "" {
-				if err = addFileToTarWriter(cfg.JoinedOutput, input.Bytes(), tarWriter); err != nil {
+				if err = addFile(cfg.JoinedOutput, input.Bytes()); err != nil {
 					return
 				}
 			}
 
-			if err = addFileToTarWriter(main, result.Bytes(), tarWriter); err != nil {
+			if err = addFile(main, result); err != nil {
 				return
 			}
 
 			for _, c := range configNames {
-				if err = addFileToTarWriter(c.Dst, []byte(strings.Join(c.Value, "\n")), tarWriter); err != nil {
+				if err = addFile(c.Dst, []byte(strings.Join(c.Value, "\n"))); err != nil {
 					return
 				}
 			}
@@ -220,7 +477,7 @@ func Exec(cfg RunConfig) (err error) {
 					return
 				}
 			}
-			if err = createFile(n, result.Bytes()); err != nil {
+			if err = createFile(n, result); err != nil {
 				return
 			}
 			for _, c := range configNames {
@@ -233,3 +490,55 @@ func Exec(cfg RunConfig) (err error) {
 
 	return
 }
+
+// writeFile writes data to the file pth of out. With noClobber, it fails if
+// the file exists.
+func writeFile(out *PathFS, pth string, data []byte, noClobber bool) (err error) {
+	var f io.WriteCloser
+	if noClobber {
+		f, err = out.CreateNew(pth)
+	} else {
+		f, err = out.CreateAll(pth)
+	}
+	if err != nil {
+		return
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return
+	}
+	return f.Close()
+}
+
+// archiveKind returns the archive format of the archive outputs, like
+// `tar:FILE:MAIN`, and dst without its prefix. The kind is empty for the
+// other outputs.
+func archiveKind(dst string) (kind, rest string) {
+	for _, kind := range []string{"tar", "tar.gz", "tgz", "zip"} {
+		if strings.HasPrefix(dst, kind+":") {
+			return kind, dst[len(kind)+1:]
+		}
+	}
+	return "", dst
+}
+
+// IsArchiveDst reports whether dst is an archive output, like `tar:FILE:MAIN`.
+func IsArchiveDst(dst string) bool {
+	kind, _ := archiveKind(dst)
+	return kind != ""
+}
+
+// parseArchiveDst parses the `FILE[:MAIN]` part of the archive outputs into
+// the archive file (`-` for the standard output) and the name of the main
+// tex file inside it. An empty main means the default name.
+func parseArchiveDst(dst string) (file, main string, err error) {
+	parts := strings.Split(dst, ":")
+	switch len(parts) {
+	case 1:
+	case 2:
+		main = parts[1]
+	default:
+		return "", "", fmt.Errorf("invalid DST value")
+	}
+	return parts[0], main, nil
+}
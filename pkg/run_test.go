@@ -0,0 +1,642 @@
+package pkg
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		pth := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(pth), 0775); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(pth, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readFile(t *testing.T, pth string) string {
+	t.Helper()
+	data, err := os.ReadFile(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func newRunConfig(dir, input, output string) RunConfig {
+	return RunConfig{
+		PathFS: PathFS{
+			RootDir: dir,
+			FS:      DirFS(dir),
+		},
+		Input:  input,
+		Output: output,
+		Now:    time.Now(),
+	}
+}
+
+func TestExecFencedDivs(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"doc.md": `Intro.
+
+::: warning
+Careful.
+:::
+
+::: {.note}
+Unmapped.
+:::
+`,
+	})
+
+	cfg := newRunConfig(dir, "doc.md", "doc.tex")
+	cfg.Opts.DivEnvironments = map[string]string{"warning": "warningbox"}
+	if err := Exec(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readFile(t, filepath.Join(dir, "doc.tex"))
+	want := "Intro.\n\n\\begin{warningbox}\nCareful.\n\n\\end{warningbox}\n\nUnmapped.\n\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// readTar returns the entry names of the tar file pth, in order, and the
+// contents of its regular files. The .gz and .tgz files are decompressed.
+func readTar(t *testing.T, pth string) (names []string, files map[string]string) {
+	t.Helper()
+	f, err := os.Open(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(pth, ".gz") || strings.HasSuffix(pth, ".tgz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	files = map[string]string{}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, h.Name)
+		if h.Typeflag != tar.TypeDir {
+			data, _ := io.ReadAll(tr)
+			files[h.Name] = string(data)
+		}
+	}
+	return
+}
+
+func TestExecTarSubdirs(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"doc.md": "Text.\n\n<!-- ::defs\n\\def\\x{1}\n-->\n",
+	})
+
+	out := filepath.Join(dir, "out.tar")
+	cfg := newRunConfig(dir, "doc.md", "tar:"+out+":src/main.tex")
+	cfg.LatexRawFiles = map[string]*LatexRaw{"defs": {Dst: "src/parts/defs.tex"}}
+	if err := Exec(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	names, files := readTar(t, out)
+
+	want := []string{"src/", "src/main.tex", "src/parts/", "src/parts/defs.tex"}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Errorf("got entries %q, want %q", names, want)
+	}
+	if got := files["src/main.tex"]; got != "Text.\n\n" {
+		t.Errorf("got main %q", got)
+	}
+	if got := files["src/parts/defs.tex"]; got != "\\def\\x{1}" {
+		t.Errorf("got raw file %q", got)
+	}
+}
+
+func TestExecNoClobber(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"doc.md": "Text.\n"})
+
+	cfg := newRunConfig(dir, "doc.md", "doc.tex")
+	cfg.NoClobber = true
+	if err := Exec(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := Exec(cfg); !errors.Is(err, os.ErrExist) {
+		t.Errorf("got error %v, want %v", err, os.ErrExist)
+	}
+
+	cfg.NoClobber = false
+	if err := Exec(cfg); err != nil {
+		t.Errorf("overwrite: %v", err)
+	}
+}
+
+func TestExecNoClobberParentDir(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"src/doc.md": "Text.\n",
+		"doc.tex":    "kept",
+	})
+
+	cfg := newRunConfig(filepath.Join(dir, "src"), "doc.md", "../doc.tex")
+	cfg.NoClobber = true
+	if err := Exec(cfg); !errors.Is(err, os.ErrExist) {
+		t.Errorf("got error %v, want %v", err, os.ErrExist)
+	}
+	if got := readFile(t, filepath.Join(dir, "doc.tex")); got != "kept" {
+		t.Errorf("overwritten with %q", got)
+	}
+}
+
+func TestExecOutputDir(t *testing.T) {
+	src, out := t.TempDir(), t.TempDir()
+	writeFiles(t, src, map[string]string{
+		"doc.md":     "Intro.\n\n:: parts/a.md\n",
+		"parts/a.md": "Included.\n",
+	})
+
+	cfg := newRunConfig(src, "doc.md", "tex/doc.tex")
+	cfg.OutputDir = out
+	cfg.JoinedOutput = "joined.md"
+	if err := Exec(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := readFile(t, filepath.Join(out, "tex/doc.tex")), "Intro.\n\nIncluded.\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	readFile(t, filepath.Join(out, "joined.md"))
+	if _, err := os.Stat(filepath.Join(src, "tex")); !os.IsNotExist(err) {
+		t.Errorf("output written to the source tree: %v", err)
+	}
+}
+
+func TestExecTarEntryNames(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"doc.md": "Text.\n"})
+
+	out := filepath.Join(dir, "out.tar")
+	cfg := newRunConfig(dir, "doc.md", "tar:"+out+":../../src/./main.tex")
+	cfg.JoinedOutput = "/../%B%.joined.md"
+	if err := Exec(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	names, _ := readTar(t, out)
+	want := []string{"doc.joined.md", "src/", "src/main.tex"}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Errorf("got entries %q, want %q", names, want)
+	}
+}
+
+func TestExecCodeInclude(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"doc.md":  "::code go main.go\n",
+		"main.go": "package main\n",
+	})
+
+	if err := Exec(newRunConfig(dir, "doc.md", "doc.tex")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, filepath.Join(dir, "doc.tex")), "\\begin{lstlisting}[language=go]\npackage main\n\\end{lstlisting}\n\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestExecInvalidOpts(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"doc.md": "# Title\n"})
+
+	cfg := newRunConfig(dir, "doc.md", "doc.tex")
+	cfg.Opts.HeadingMap = []string{""}
+	if err := Exec(cfg); err == nil || !strings.Contains(err.Error(), "heading map") {
+		t.Errorf("got error %v, want a heading map error", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "doc.tex")); !os.IsNotExist(err) {
+		t.Errorf("output written: %v", err)
+	}
+}
+
+func TestExecIncludePrefix(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"doc.md":  ":: kept\n\n@include a.md\n\n@includecode go main.go\n",
+		"a.md":    "Included.\n",
+		"main.go": "package main\n",
+	})
+
+	cfg := newRunConfig(dir, "doc.md", "doc.tex")
+	cfg.IncludePrefix = "@include "
+	if err := Exec(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, filepath.Join(dir, "doc.tex")), ":: kept\n\nIncluded.\n\n\\begin{lstlisting}[language=go]\npackage main\n\\end{lstlisting}\n\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestExecVars(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"doc.md": "Version {{version}}, \\{{version}} and {{unknown}}.\n",
+	})
+
+	cfg := newRunConfig(dir, "doc.md", "doc.tex")
+	cfg.Vars = map[string]string{"version": "1.2"}
+	if err := Exec(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, filepath.Join(dir, "doc.tex")), "Version 1.2, \\{\\{version\\}\\} and \\{\\{unknown\\}\\}.\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestExecIgnoreMissingIncludes(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"doc.md": "Before.\n\n:: parts/missing.md\n\nAfter.\n"})
+
+	cfg := newRunConfig(dir, "doc.md", "doc.tex")
+	if err := Exec(cfg); err == nil {
+		t.Fatal("missing include ignored by default")
+	}
+
+	cfg.IgnoreMissingIncludes = true
+	if err := Exec(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, filepath.Join(dir, "doc.tex")), "Before.\n\n% MISSING INCLUDE: parts/missing.md\n\nAfter.\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestExecZip(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"doc.md": "Text.\n\n<!-- ::defs\n\\def\\x{1}\n-->\n",
+	})
+
+	out := filepath.Join(dir, "out.zip")
+	cfg := newRunConfig(dir, "doc.md", "zip:"+out+":src/main.tex")
+	cfg.JoinedOutput = "%B%.joined.md"
+	cfg.LatexRawFiles = map[string]*LatexRaw{"defs": {Dst: "src/defs.tex"}}
+	if err := Exec(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.OpenReader(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	files := map[string]string{}
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(data)
+	}
+	for name, want := range map[string]string{
+		"doc.joined.md": readFile(t, filepath.Join(dir, "doc.md")),
+		"src/main.tex":  "Text.\n\n",
+		"src/defs.tex":  "\\def\\x{1}",
+	} {
+		if got := files[name]; got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestExecArchiveCloseError(t *testing.T) {
+	// the archive writers buffer the entries, so they are written on close
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("no /dev/full")
+	}
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"doc.md": "Text.\n"})
+
+	for _, kind := range []string{"zip", "tar.gz"} {
+		if err := Exec(newRunConfig(dir, "doc.md", kind+":/dev/full")); err == nil {
+			t.Errorf("%s: got no error, want the write error of the archive writer close", kind)
+		}
+	}
+}
+
+func TestExecTarGz(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"doc.md": "Text.\n"})
+
+	for _, v := range []struct{ prefix, file string }{
+		{"tar.gz:", "out.tar.gz"},
+		{"tgz:", "out.tgz"},
+	} {
+		out := filepath.Join(dir, v.file)
+		if err := Exec(newRunConfig(dir, "doc.md", v.prefix+out)); err != nil {
+			t.Fatal(err)
+		}
+		if _, files := readTar(t, out); files["doc.tex"] != "Text.\n" {
+			t.Errorf("%s: got files %q", v.file, files)
+		}
+	}
+}
+
+func TestExecTarReproducible(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"doc.md": "Text.\n"})
+
+	var tars []string
+	for _, name := range []string{"a.tar", "b.tar"} {
+		cfg := newRunConfig(dir, "doc.md", "tar:"+filepath.Join(dir, name)+":src/doc.tex")
+		cfg.Now = time.Time{}
+		cfg.TarFileMode = 0644
+		if err := Exec(cfg); err != nil {
+			t.Fatal(err)
+		}
+		tars = append(tars, readFile(t, filepath.Join(dir, name)))
+	}
+	if tars[0] != tars[1] {
+		t.Error("tar outputs differ")
+	}
+
+	f, err := os.Open(filepath.Join(dir, "a.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if !h.ModTime.Equal(ArchiveEpoch) {
+			t.Errorf("%s: got modtime %v", h.Name, h.ModTime)
+		}
+		if h.Typeflag != tar.TypeDir && h.Mode != 0644 {
+			t.Errorf("%s: got mode %o", h.Name, h.Mode)
+		}
+	}
+}
+
+func TestExecZipReproducible(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"doc.md": "Text.\n"})
+
+	out := filepath.Join(dir, "out.zip")
+	cfg := newRunConfig(dir, "doc.md", "zip:"+out)
+	cfg.Now = time.Time{}
+	if err := Exec(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.OpenReader(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		if !f.Modified.Equal(ArchiveEpoch) {
+			t.Errorf("%s: got modtime %v", f.Name, f.Modified)
+		}
+	}
+}
+
+func TestExecSetPragma(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"doc.md": "http://example.com/a\n\n<!-- ::set shorten_autolinks=true -->\n\nhttp://example.com/b\n",
+	})
+
+	if err := Exec(newRunConfig(dir, "doc.md", "doc.tex")); err != nil {
+		t.Fatal(err)
+	}
+	want := "\\href{http://example.com/a}{http://example.com/a}\n\n" +
+		"\\href{http://example.com/b}{example.com\\ldots{}}\n"
+	if got := readFile(t, filepath.Join(dir, "doc.tex")); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestExecSetPragmaTOC(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"doc.md": "# A\n\n<!-- ::set toc=true -->\n\n# B\n",
+	})
+
+	cfg := newRunConfig(dir, "doc.md", "doc.tex")
+	cfg.Opts.Flags = CompletePage
+	cfg.Opts.Title = "Title"
+	if err := Exec(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(dir, "doc.tex")); !strings.Contains(got, `\tableofcontents`) {
+		t.Errorf("no table of contents in:\n%s", got)
+	}
+}
+
+func TestExecSetPragmaHeader(t *testing.T) {
+	for _, v := range []struct {
+		doc, want string
+	}{
+		{"<x@example.com>\n\n<!-- ::set email_command=email -->\n", `\providecommand{\email}[1]{\texttt{#1}}`},
+		{"<!-- ::set color_spans=true -->\n\nA <span style=\"color:red\">b</span>.\n", `\usepackage{xcolor}`},
+		{"<!-- ::set highlight=true highlight_color=yellow -->\n\nA ==b==.\n", "\\usepackage{soul}\n\\sethlcolor{yellow}"},
+	} {
+		dir := t.TempDir()
+		writeFiles(t, dir, map[string]string{"doc.md": "Text.\n\n" + v.doc})
+
+		cfg := newRunConfig(dir, "doc.md", "doc.tex")
+		cfg.Opts.Flags = CompletePage
+		if err := Exec(cfg); err != nil {
+			t.Fatal(err)
+		}
+		if got := readFile(t, filepath.Join(dir, "doc.tex")); !strings.Contains(got, v.want) {
+			t.Errorf("%q: %s not found in:\n%s", v.doc, v.want, got)
+		}
+	}
+}
+
+func TestExecCheck(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"doc.md": "See [a](a.md), [b](missing.md), [web](https://example.com).\n\n![logo](img/logo.png)\n",
+		"a.md":   "A\n",
+		"ok.md":  "See [a](a.md).\n",
+	})
+
+	var log strings.Builder
+	cfg := newRunConfig(dir, "doc.md", "doc.tex")
+	cfg.Check = true
+	cfg.LogWriter = &log
+	err := Exec(cfg)
+	if err == nil {
+		t.Fatal("no issues reported")
+	}
+	if want := `warning: doc.md: relative link "a" to "a.md"`; !strings.Contains(log.String(), want) {
+		t.Errorf("%q not found in the log %q", want, log.String())
+	}
+	for _, want := range []string{"2 issue(s)", "broken link: missing.md", "missing image: img/logo.png"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%q not found in %q", want, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "doc.tex")); !os.IsNotExist(err) {
+		t.Errorf("output written: %v", err)
+	}
+
+	cfg.Input = "ok.md"
+	if err := Exec(cfg); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExecLog(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"doc.md": "Intro.\n\n:: a.md\n",
+		"a.md":   "A\n",
+	})
+
+	for _, v := range []struct {
+		verbosity int
+		want      []string
+	}{
+		{LogQuiet, nil},
+		{LogNormal, []string{"======>> begin doc.md", "include -- 002: .: a.md"}},
+		{LogVerbose, []string{"======>> begin doc.md", "write " + filepath.ToSlash(filepath.Join(dir, "doc.tex"))}},
+	} {
+		var log strings.Builder
+		cfg := newRunConfig(dir, "doc.md", "doc.tex")
+		cfg.LogWriter = &log
+		cfg.Verbosity = v.verbosity
+		if err := Exec(cfg); err != nil {
+			t.Fatal(err)
+		}
+		if v.want == nil && log.Len() > 0 {
+			t.Errorf("verbosity %d: got log %q", v.verbosity, log.String())
+		}
+		for _, want := range v.want {
+			if !strings.Contains(log.String(), want) {
+				t.Errorf("verbosity %d: %q not found in %q", v.verbosity, want, log.String())
+			}
+		}
+	}
+}
+
+func TestExecQuietWarnings(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"doc.md": "Intro.\n\n:: missing.md\n\n<!-- ::set unknown=1 -->\n"})
+
+	var log strings.Builder
+	cfg := newRunConfig(dir, "doc.md", "doc.tex")
+	cfg.LogWriter = &log
+	cfg.Verbosity = LogQuiet
+	cfg.IgnoreMissingIncludes = true
+	if err := Exec(cfg); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"warning: missing include", "warning: doc.md: "} {
+		if !strings.Contains(log.String(), want) {
+			t.Errorf("%q not found in %q", want, log.String())
+		}
+	}
+	if strings.Contains(log.String(), "begin") {
+		t.Errorf("got the progress log %q", log.String())
+	}
+}
+
+func TestExecDryRun(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"doc.md": "Text.\n\n<!-- ::defs\n\\def\\x{1}\n-->\n",
+	})
+
+	for _, v := range []struct {
+		output string
+		want   []string
+	}{
+		{"doc.tex", []string{
+			filepath.ToSlash(filepath.Join(dir, "doc.tex")) + " (7 bytes)",
+			filepath.ToSlash(filepath.Join(dir, "doc.joined.md")) + " (",
+			filepath.ToSlash(filepath.Join(dir, "defs.tex")) + " (9 bytes)",
+		}},
+		{"tar:out.tar", []string{"out.tar:doc.tex (7 bytes)", "out.tar:defs.tex (9 bytes)"}},
+	} {
+		var log strings.Builder
+		cfg := newRunConfig(dir, "doc.md", v.output)
+		cfg.JoinedOutput = "%B%.joined.md"
+		cfg.LatexRawFiles = map[string]*LatexRaw{"defs": {Dst: "defs.tex"}}
+		cfg.LogWriter = &log
+		cfg.Verbosity = LogQuiet
+		cfg.DryRun = true
+		if err := Exec(cfg); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range v.want {
+			if !strings.Contains(log.String(), want) {
+				t.Errorf("%s: %q not found in %q", v.output, want, log.String())
+			}
+		}
+	}
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("files written: %v", entries)
+	}
+}
+
+func TestExecStdin(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"parts/a.md": "Included.\n"})
+
+	cfg := newRunConfig(dir, "-", "doc.tex")
+	cfg.Stdin = strings.NewReader("Piped.\n\n:: parts/a.md\n")
+	if err := Exec(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, filepath.Join(dir, "doc.tex")), "Piped.\n\nIncluded.\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	cfg.Stdin = strings.NewReader("Piped.\n")
+	cfg.Output = "tar:" + filepath.Join(dir, "out.tar")
+	if err := Exec(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, files := readTar(t, filepath.Join(dir, "out.tar")); files["stdin.tex"] != "Piped.\n" {
+		t.Errorf("got files %q", files)
+	}
+}
@@ -4,7 +4,16 @@ package pkg
 
 import "bytes"
 
-var validUris = [][]byte{[]byte("http://"), []byte("https://"), []byte("ftp://"), []byte("mailto://")}
+// DefaultTrustedProtocols are the default Opts.TrustedProtocols.
+var DefaultTrustedProtocols = []string{"http", "https", "mailto"}
+
+func (r *Renderer) trustedProtocols() []string {
+	if r.TrustedProtocols == nil {
+		return DefaultTrustedProtocols
+	}
+	return r.TrustedProtocols
+}
+
 var validPaths = [][]byte{[]byte("/"), []byte("./"), []byte("../")}
 
 // Test if a character is letter.
@@ -17,7 +26,7 @@ func isalnum(c byte) bool {
 	return (c >= '0' && c <= '9') || isletter(c)
 }
 
-func isSafeLink(link []byte) bool {
+func isSafeLink(link []byte, protocols []string) bool {
 	for _, path := range validPaths {
 		if len(link) >= len(path) && bytes.Equal(link[:len(path)], path) {
 			if len(link) == len(path) {
@@ -28,24 +37,24 @@ func isSafeLink(link []byte) bool {
 		}
 	}
 
-	for _, prefix := range validUris {
+	for _, protocol := range protocols {
+		prefix := []byte(protocol + ":")
 		// TODO: handle unicode here
 		// case-insensitive prefix test
-		if len(link) > len(prefix) && bytes.Equal(bytes.ToLower(link[:len(prefix)]), prefix) && isalnum(link[len(prefix)]) {
-			return true
+		if len(link) > len(prefix) && bytes.Equal(bytes.ToLower(link[:len(prefix)]), bytes.ToLower(prefix)) {
+			// the authority slashes are optional, as in `mailto:` and `tel:`
+			if rest := bytes.TrimPrefix(link[len(prefix):], []byte("//")); len(rest) > 0 {
+				return true
+			}
 		}
 	}
 
 	return false
 }
 
-func isMailto(link []byte) bool {
-	return bytes.HasPrefix(link, []byte("mailto:"))
-}
-
-func needSkipLink(flags Flag, dest []byte) bool {
+func needSkipLink(flags Flag, protocols []string, dest []byte) bool {
 	if flags&SkipLinks != 0 {
 		return true
 	}
-	return flags&Safelink != 0 && !isSafeLink(dest) && !isMailto(dest)
+	return flags&Safelink != 0 && !isSafeLink(dest, protocols)
 }
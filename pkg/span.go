@@ -0,0 +1,129 @@
+package pkg
+
+import (
+	"io"
+	"strings"
+)
+
+// spanCommand parses the opening tags of the inline color spans: the
+// `<span style="color:red">` spans, rendered as `\textcolor`, and the `<mark>`
+// spans, rendered as the `\hl` of soul. It returns the LaTeX opening the span,
+// which is empty for the spans without color, and whether tag opens a span.
+func spanCommand(tag []byte) (open string, ok bool) {
+	s := strings.ToLower(strings.TrimSpace(string(tag)))
+	switch {
+	case s == "<mark>":
+		return `\hl{`, true
+	case s == "<span>":
+		return "", true
+	case !strings.HasPrefix(s, "<span") || !strings.HasSuffix(s, ">") || !isSpace(s[5]):
+		return "", false
+	}
+	color := styleColor(string(tag))
+	switch {
+	case color == "":
+		return "", true
+	case color[0] == '#':
+		return `\textcolor[HTML]{` + color[1:] + `}{`, true
+	default:
+		return `\textcolor{` + color + `}{`, true
+	}
+}
+
+// isSpanEnd tells whether tag closes a span opened by a spanCommand tag.
+func isSpanEnd(tag []byte) bool {
+	s := strings.ToLower(strings.TrimSpace(string(tag)))
+	return s == "</span>" || s == "</mark>"
+}
+
+// styleColor returns the `color` property of the style attribute of tag, if
+// it is a named xcolor color, like `red` or `blue!50`, or a `#rrggbb` or
+// `#rgb` one, returned as `#RRGGBB`.
+func styleColor(tag string) string {
+	pos := strings.Index(strings.ToLower(tag), "style=")
+	if pos < 0 || pos+6 >= len(tag) {
+		return ""
+	}
+	style, quote := tag[pos+6:], tag[pos+6]
+	if quote != '"' && quote != '\'' {
+		return ""
+	}
+	if end := strings.IndexByte(style[1:], quote); end >= 0 {
+		style = style[1 : end+1]
+	} else {
+		return ""
+	}
+	for _, decl := range strings.Split(style, ";") {
+		pos := strings.IndexByte(decl, ':')
+		if pos < 0 || strings.ToLower(strings.TrimSpace(decl[:pos])) != "color" {
+			continue
+		}
+		color := strings.TrimSpace(decl[pos+1:])
+		if strings.HasPrefix(color, "#") {
+			return hexColor(color[1:])
+		}
+		if isColorName(color) {
+			return color
+		}
+		return ""
+	}
+	return ""
+}
+
+// hexColor returns the `rrggbb` or `rgb` hex color s as `#RRGGBB`, or an
+// empty string if s isn't one.
+func hexColor(s string) string {
+	if len(s) != 3 && len(s) != 6 {
+		return ""
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return ""
+		}
+	}
+	if len(s) == 3 {
+		s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+	}
+	return "#" + strings.ToUpper(s)
+}
+
+func isColorName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '!') {
+			return false
+		}
+	}
+	return true
+}
+
+// renderSpan renders the opening and closing tags of the color spans and
+// reports whether tag was one of them.
+func (r *Renderer) renderSpan(w io.Writer, tag []byte) bool {
+	if open, ok := spanCommand(tag); ok {
+		WriteString(w, open)
+		closing := ""
+		if open != "" {
+			closing = "}"
+		}
+		r.spans = append(r.spans, closing)
+		return true
+	}
+	if isSpanEnd(tag) && len(r.spans) > 0 {
+		WriteString(w, r.spans[len(r.spans)-1])
+		r.spans = r.spans[:len(r.spans)-1]
+		return true
+	}
+	return false
+}
+
+// closeSpans closes the color spans left open, at the end of their
+// paragraph, heading or table cell, so that their braces are balanced.
+func (r *Renderer) closeSpans(w io.Writer) {
+	for i := len(r.spans) - 1; i >= 0; i-- {
+		WriteString(w, r.spans[i])
+	}
+	r.spans = r.spans[:0]
+}
@@ -1,10 +1,38 @@
 package pkg
 
 import (
+	"bytes"
+	"io"
+	"os"
 	"path"
 	"strings"
+	"sync"
 )
 
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// getBuffer returns an empty buffer from the pool. Give it back with
+// putBuffer once its bytes are no longer referenced.
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// maxPooledBuffer is the capacity above which the buffers are dropped
+// instead of pooled, so that a large document doesn't keep its memory.
+const maxPooledBuffer = 1 << 20
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
 func FormatFileName(fmt, name string) string {
 	return strings.ReplaceAll(
 		strings.ReplaceAll(
@@ -13,3 +41,137 @@ func FormatFileName(fmt, name string) string {
 			"%B%", strings.TrimSuffix(path.Base(name), ".md")),
 		"%BE%", path.Base(name))
 }
+
+// tarEntryName cleans name for a tar entry: forward slashes, relative and
+// without `..` elements, so that the archive extracts inside its directory.
+func tarEntryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(name, `\`, "/")), "/")
+}
+
+// substituteVars replaces the `{{name}}` tokens of data by vars[name].
+// Unknown tokens are kept. A backslash before the braces, as in
+// `\{{name}}`, keeps them literally: it renders `{{name}}`.
+func substituteVars(data []byte, vars map[string]string) []byte {
+	var out bytes.Buffer
+	for {
+		pos := bytes.Index(data, []byte("{{"))
+		if pos < 0 {
+			break
+		}
+		if pos > 0 && data[pos-1] == '\\' {
+			out.Write(data[:pos-1])
+			out.WriteString("{{")
+			data = data[pos+2:]
+			continue
+		}
+		out.Write(data[:pos])
+		data = data[pos:]
+		end := bytes.Index(data, []byte("}}"))
+		if end < 0 {
+			break
+		}
+		if v, ok := vars[strings.TrimSpace(string(data[2:end]))]; ok {
+			out.WriteString(v)
+			data = data[end+2:]
+		} else {
+			out.WriteByte('{')
+			data = data[1:]
+		}
+	}
+	out.Write(data)
+	return out.Bytes()
+}
+
+// substituteMarkdownVars is substituteVars out of the fenced code blocks and
+// the code spans of the markdown data, which are kept verbatim.
+func substituteMarkdownVars(data []byte, vars map[string]string) []byte {
+	var (
+		out  bytes.Buffer
+		text []byte
+		// the closing fence of the open code block
+		fence []byte
+	)
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		trimmed := bytes.TrimLeft(line, " ")
+		if fence != nil {
+			out.Write(line)
+			if bytes.HasPrefix(trimmed, fence) && len(bytes.TrimSpace(bytes.TrimLeft(trimmed, string(fence[:1])))) == 0 {
+				fence = nil
+			}
+			continue
+		}
+		if bytes.HasPrefix(trimmed, []byte("```")) || bytes.HasPrefix(trimmed, []byte("~~~")) {
+			substituteSpanVars(&out, text, vars)
+			text = text[:0]
+			out.Write(line)
+			fence = trimmed[:len(trimmed)-len(bytes.TrimLeft(trimmed, string(trimmed[:1])))]
+			continue
+		}
+		text = append(text, line...)
+	}
+	substituteSpanVars(&out, text, vars)
+	return out.Bytes()
+}
+
+// substituteSpanVars writes text to out with its vars substituted out of its
+// code spans, delimited by equal backtick strings.
+func substituteSpanVars(out *bytes.Buffer, text []byte, vars map[string]string) {
+	for {
+		start := bytes.IndexByte(text, '`')
+		if start < 0 {
+			break
+		}
+		n := backticks(text[start:])
+		end := closingBackticks(text[start+n:], n)
+		if end < 0 {
+			// literal backticks
+			out.Write(substituteVars(text[:start+n], vars))
+			text = text[start+n:]
+			continue
+		}
+		end += start + 2*n
+		out.Write(substituteVars(text[:start], vars))
+		out.Write(text[start:end])
+		text = text[end:]
+	}
+	out.Write(substituteVars(text, vars))
+}
+
+// backticks returns the number of backticks starting text.
+func backticks(text []byte) int {
+	return len(text) - len(bytes.TrimLeft(text, "`"))
+}
+
+// closingBackticks returns the index of the first string of n backticks of
+// text, or -1.
+func closingBackticks(text []byte, n int) int {
+	for i := 0; i < len(text); {
+		if text[i] != '`' {
+			i++
+			continue
+		}
+		m := backticks(text[i:])
+		if m == n {
+			return i
+		}
+		i += m
+	}
+	return -1
+}
+
+// syncWriter serializes the writes to w, so that the lines logged by
+// concurrent Exec calls are not garbled.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (sw *syncWriter) Write(p []byte) (int, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.w.Write(p)
+}
+
+// stderr is the progress log, safe for concurrent use. Log each line with a
+// single write.
+var stderr io.Writer = &syncWriter{w: os.Stderr}
@@ -0,0 +1,60 @@
+package pkg
+
+import "testing"
+
+func TestTarEntryName(t *testing.T) {
+	for name, want := range map[string]string{
+		"main.tex":             "main.tex",
+		"src/./main.tex":       "src/main.tex",
+		"/abs/main.tex":        "abs/main.tex",
+		"../../etc/main.tex":   "etc/main.tex",
+		"src/../../main.tex":   "main.tex",
+		`src\parts\defs.tex`:   "src/parts/defs.tex",
+		"a/b/../%D%/joined.md": "a/%D%/joined.md",
+	} {
+		if got := tarEntryName(name); got != want {
+			t.Errorf("%q: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestSubstituteVars(t *testing.T) {
+	vars := map[string]string{"version": "1.2", "name": "md2latex"}
+	for in, want := range map[string]string{
+		"v{{version}}":             "v1.2",
+		"{{ name }} {{version}}.":  "md2latex 1.2.",
+		"{{unknown}} {{version}}":  "{{unknown}} 1.2",
+		`\{{version}} {{version}}`: "{{version}} 1.2",
+		"{{{version}}}":            "{1.2}",
+		"open {{version":           "open {{version",
+		"no tokens":                "no tokens",
+	} {
+		if got := string(substituteVars([]byte(in), vars)); got != want {
+			t.Errorf("%q: got %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestSubstituteMarkdownVars(t *testing.T) {
+	vars := map[string]string{"version": "1.2"}
+	for in, want := range map[string]string{
+		"v{{version}} `{{version}}` {{version}}":       "v1.2 `{{version}}` 1.2",
+		"``a ` {{version}}`` {{version}}":              "``a ` {{version}}`` 1.2",
+		"a ` {{version}}":                              "a ` 1.2",
+		"```\n{{version}}\n```\n{{version}}\n":         "```\n{{version}}\n```\n1.2\n",
+		"~~~~ go\n{{version}}\n~~~\n~~~~\n{{version}}": "~~~~ go\n{{version}}\n~~~\n~~~~\n1.2",
+	} {
+		if got := string(substituteMarkdownVars([]byte(in), vars)); got != want {
+			t.Errorf("%q: got %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestPutBufferDropsLargeBuffers(t *testing.T) {
+	buf := getBuffer()
+	buf.Grow(maxPooledBuffer + 1)
+	putBuffer(buf)
+	if got := getBuffer(); got.Cap() > maxPooledBuffer {
+		t.Errorf("got a pooled buffer of capacity %d", got.Cap())
+	}
+}